@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"syscall"
 	"time"
@@ -27,11 +28,26 @@ func main() {
 		log.Fatal("SERVER_WS_URL not set")
 	}
 
+	// tcp (or unix:/path), the unix socket options below can be used instead or next to it
 	terminalRawTcpURL := os.Getenv("CONTROLLER_RAW_SOCKETS_URL")
-	if terminalRawTcpURL == "" {
+	terminalListen := common.TerminalListenConfig{
+		UnixSocket:        os.Getenv("CONTROLLER_TERMINAL_UNIX_SOCKET"),
+		PerTerminalSocket: common.EnvBool("CONTROLLER_TERMINAL_SOCKET_PER_TERMINAL", false),
+		SocketMode:        0660,
+	}
+
+	if terminalRawTcpURL == "" && terminalListen.UnixSocket == "" && !terminalListen.PerTerminalSocket {
 		log.Fatal("CONTROLLER_RAW_SOCKETS_URL not set")
 	}
 
+	if mode := os.Getenv("CONTROLLER_TERMINAL_SOCKET_MODE"); mode != "" {
+		parsed, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			log.Fatal("Invalid CONTROLLER_TERMINAL_SOCKET_MODE set - octal permissions required (e.g. 0660)")
+		}
+		terminalListen.SocketMode = os.FileMode(parsed)
+	}
+
 	controllerId := os.Getenv("CONTROLLER_ID")
 	if controllerId == "" {
 		log.Fatal("CONTROLLER_ID not set")
@@ -53,6 +69,20 @@ func main() {
 		log.Fatal("Invalid CONTROLLER_CAPACITY set - int required")
 	}
 
+	queueOverflow := common.OverflowPolicy(common.EnvString("CONTROLLER_TERMINAL_QUEUE_OVERFLOW", string(common.OverflowReject)))
+	if queueOverflow != common.OverflowReject && queueOverflow != common.OverflowDropOldestData {
+		log.Fatalf("Invalid CONTROLLER_TERMINAL_QUEUE_OVERFLOW set - %s or %s required", common.OverflowReject, common.OverflowDropOldestData)
+	}
+
+	// USE_PODS is the old switch, CONTROLLER_TERMINAL_RUNTIME wins when both are set
+	defaultRuntime := "raw"
+	if common.EnvBool("USE_PODS", false) {
+		defaultRuntime = "podman"
+	}
+	terminalRuntime := common.EnvString("CONTROLLER_TERMINAL_RUNTIME", defaultRuntime)
+
+	dataDir := common.EnvString("CONTROLLER_DATA_DIR", "./data")
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -62,6 +92,49 @@ func main() {
 		ServerWsUrl:       serverWsURL,
 		TerminalRawTcpUrl: terminalRawTcpURL,
 		Capacity:          intCtrlCapacity,
+		DataDir:           dataDir,
+		AckRetry:          common.RetryPolicyFromEnv("CONTROLLER"),
+		DedupeWindow:      common.EnvInt("CONTROLLER_DEDUPE_WINDOW", 4096),
+		Heartbeat:         common.HeartbeatFromEnv("CONTROLLER"),
+		Reconnect:         common.BackoffFromEnv("CONTROLLER_RECONNECT"),
+		Compression:       common.EnvBool("CONTROLLER_WS_COMPRESSION", false),
+		Batching: common.BatchConfig{
+			FlushWindow: common.EnvDuration("CONTROLLER_BATCH_WINDOW", 0),
+			MaxItems:    common.EnvInt("CONTROLLER_BATCH_MAX_ITEMS", 500),
+			MaxBytes:    common.EnvInt("CONTROLLER_BATCH_MAX_BYTES", 512*1024),
+		},
+		ResponseFileTTL: common.EnvDuration("CONTROLLER_RESPONSE_FILE_TTL", 24*time.Hour),
+		TerminalListen:  terminalListen,
+		Watchdog: common.WatchdogConfig{
+			Interval:     common.EnvDuration("CONTROLLER_TERMINAL_HEARTBEAT", 10*time.Second),
+			StaleAfter:   common.EnvDuration("CONTROLLER_TERMINAL_STALE_AFTER", 30*time.Second),
+			RestartAfter: common.EnvDuration("CONTROLLER_TERMINAL_RESTART_AFTER", 2*time.Minute),
+			MaxRestarts:  common.EnvInt("CONTROLLER_TERMINAL_MAX_RESTARTS", 3),
+		},
+		TerminalFraming: common.TerminalFramingConfig{
+			MaxFrameSize: common.EnvInt("CONTROLLER_TERMINAL_MAX_FRAME", 1<<20),
+			AllowFramed:  common.EnvBool("CONTROLLER_TERMINAL_FRAMING", true),
+		},
+		TerminalQueue: common.TerminalQueueConfig{
+			Size:     common.EnvInt("CONTROLLER_TERMINAL_QUEUE_SIZE", 256),
+			Overflow: queueOverflow,
+		},
+		TerminalRuntime: terminalRuntime,
+		Supervisor: common.SupervisorConfig{
+			Backoff: common.BackoffConfig{
+				Initial: common.EnvDuration("CONTROLLER_TERMINAL_CRASH_BACKOFF_INITIAL", 5*time.Second),
+				Max:     common.EnvDuration("CONTROLLER_TERMINAL_CRASH_BACKOFF_MAX", 5*time.Minute),
+			}.WithDefaults(),
+			MaxCrashes:  common.EnvInt("CONTROLLER_TERMINAL_MAX_CRASHES", 5),
+			StableAfter: common.EnvDuration("CONTROLLER_TERMINAL_STABLE_AFTER", 5*time.Minute),
+			MaxLogSize:  int64(common.EnvInt("CONTROLLER_TERMINAL_LOG_MAX", 10<<20)),
+		},
+		BasesDir: common.EnvString("CONTROLLER_BASES_DIR", filepath.Join(dataDir, "bases")),
+		Podman: common.PodmanConfig{
+			Binary:  common.EnvString("CONTROLLER_PODMAN_BINARY", "podman"),
+			Image:   os.Getenv("CONTROLLER_PODMAN_IMAGE"),
+			Network: common.EnvString("CONTROLLER_PODMAN_NETWORK", "host"),
+		},
 	}
 
 	ctrl, err := controller.NewController(srvConfig)
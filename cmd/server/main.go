@@ -1,6 +1,7 @@
 package main
 
 import (
+	"backend/internal/common"
 	"backend/internal/server"
 	"context"
 	"log"
@@ -27,7 +28,13 @@ func main() {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	ctrl, err := server.NewServer(serverTcpAddr)
+	ctrl, err := server.NewServer(common.ServerConfig{
+		Addr:           serverTcpAddr,
+		AckRetry:       common.RetryPolicyFromEnv("SERVER"),
+		RequestTimeout: common.EnvDuration("SERVER_REQUEST_TIMEOUT", 30*time.Second),
+		Heartbeat:      common.HeartbeatFromEnv("SERVER"),
+		Compression:    common.EnvBool("SERVER_WS_COMPRESSION", true),
+	})
 
 	if err != nil {
 		log.Fatalf("encountered error init app: %v", err)
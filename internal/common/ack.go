@@ -0,0 +1,178 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AckKind string
+
+const (
+	AckRequest  AckKind = "request"  // controller received a TaskReq
+	AckResponse AckKind = "response" // server received a TaskRes
+)
+
+func (k AckKind) MarshalJSON() ([]byte, error) {
+	return json.Marshal(string(k))
+}
+
+func (k *AckKind) UnmarshalJSON(b []byte) error {
+	var str string
+
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+
+	switch strings.TrimSpace(str) {
+	case string(AckRequest):
+		*k = AckRequest
+	case string(AckResponse):
+		*k = AckResponse
+	default:
+		return fmt.Errorf("invalid ack kind value: %s", str)
+	}
+
+	return nil
+}
+
+// TaskAck is sent by either side once it has taken ownership of a request/response
+type TaskAck struct {
+	Kind  AckKind `json:"ack_kind"`
+	ReqId int     `json:"request_id"`
+	Seq   uint64  `json:"seq,omitempty"` // outbox sequence of the acked response, requests with many results are acked one by one
+}
+
+func NewTaskAck(kind AckKind, reqId int) TaskAck {
+	return TaskAck{
+		Kind:  kind,
+		ReqId: reqId,
+	}
+}
+
+type RetryPolicy struct {
+	Timeout     time.Duration // how long to wait for an ack before resending
+	MaxAttempts int           // total sends (including the first) before giving up
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Timeout:     10 * time.Second,
+	MaxAttempts: 5,
+}
+
+type unacked[T any] struct {
+	seq      uint64
+	item     T
+	attempts int
+	deadline time.Time
+}
+
+// RetryTracker keeps items that were sent but not acked yet, keyed by request id
+type RetryTracker[T any] struct {
+	mu      sync.Mutex
+	policy  RetryPolicy
+	nextSeq uint64
+	items   map[int]*unacked[T]
+}
+
+func NewRetryTracker[T any](policy RetryPolicy) *RetryTracker[T] {
+	if policy.Timeout <= 0 {
+		policy.Timeout = DefaultRetryPolicy.Timeout
+	}
+
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+
+	return &RetryTracker[T]{
+		policy: policy,
+		items:  make(map[int]*unacked[T]),
+	}
+}
+
+func (rt *RetryTracker[T]) Policy() RetryPolicy {
+	return rt.policy
+}
+
+// Track records a send of the item, tracking the same id again counts as another attempt
+func (rt *RetryTracker[T]) Track(id int, item T) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if existing, ok := rt.items[id]; ok {
+		existing.item = item
+		existing.attempts++
+		existing.deadline = time.Now().Add(rt.policy.Timeout)
+		return
+	}
+
+	rt.items[id] = &unacked[T]{
+		seq:      rt.nextSeq,
+		item:     item,
+		attempts: 1,
+		deadline: time.Now().Add(rt.policy.Timeout),
+	}
+	rt.nextSeq++
+}
+
+func (rt *RetryTracker[T]) Ack(id int) bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if _, ok := rt.items[id]; !ok {
+		return false
+	}
+
+	delete(rt.items, id)
+	return true
+}
+
+// Due returns the items whose ack deadline has passed, in the order they were first tracked.
+// Items with attempts left are rescheduled and returned in retry, the rest are dropped and returned in expired
+func (rt *RetryTracker[T]) Due(now time.Time) (retry []T, expired []T) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	due := make([]*unacked[T], 0)
+	for _, entry := range rt.items {
+		if !now.Before(entry.deadline) {
+			due = append(due, entry)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool { return due[i].seq < due[j].seq })
+	for id, entry := range rt.items {
+		if !now.Before(entry.deadline) && entry.attempts >= rt.policy.MaxAttempts {
+			delete(rt.items, id)
+		}
+	}
+
+	for _, entry := range due {
+		if entry.attempts >= rt.policy.MaxAttempts {
+			expired = append(expired, entry.item)
+			continue
+		}
+
+		entry.attempts++
+		entry.deadline = now.Add(rt.policy.Timeout)
+		retry = append(retry, entry.item)
+	}
+
+	return retry, expired
+}
+
+// Clear forgets every tracked item, used when a new connection replays from a durable store
+func (rt *RetryTracker[T]) Clear() {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.items = make(map[int]*unacked[T])
+}
+
+func (rt *RetryTracker[T]) Len() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return len(rt.items)
+}
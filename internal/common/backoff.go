@@ -0,0 +1,88 @@
+package common
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+type BackoffConfig struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64 // fraction of the delay that is randomised, 0..1
+}
+
+var DefaultBackoff = BackoffConfig{
+	Initial:    500 * time.Millisecond,
+	Max:        60 * time.Second,
+	Multiplier: 2,
+	Jitter:     0.5,
+}
+
+func (c BackoffConfig) WithDefaults() BackoffConfig {
+	if c.Initial <= 0 {
+		c.Initial = DefaultBackoff.Initial
+	}
+
+	if c.Max < c.Initial {
+		c.Max = max(DefaultBackoff.Max, c.Initial)
+	}
+
+	if c.Multiplier < 1 {
+		c.Multiplier = DefaultBackoff.Multiplier
+	}
+
+	if c.Jitter < 0 || c.Jitter > 1 {
+		c.Jitter = DefaultBackoff.Jitter
+	}
+
+	return c
+}
+
+// Backoff hands out jittered exponential delays, not safe for concurrent use
+type Backoff struct {
+	conf    BackoffConfig
+	attempt int
+}
+
+func NewBackoff(conf BackoffConfig) *Backoff {
+	return &Backoff{conf: conf.WithDefaults()}
+}
+
+// Next returns the delay before the next attempt and moves the backoff along
+func (b *Backoff) Next() time.Duration {
+	delay := float64(b.conf.Initial)
+	for i := 0; i < b.attempt && delay < float64(b.conf.Max); i++ {
+		delay *= b.conf.Multiplier
+	}
+	delay = min(delay, float64(b.conf.Max))
+
+	b.attempt++
+
+	// spread reconnects out so a server restart doesn't get every controller at once
+	jitter := delay * b.conf.Jitter * rand.Float64()
+	return time.Duration(delay - jitter)
+}
+
+func (b *Backoff) Attempt() int {
+	return b.attempt
+}
+
+// Reset starts over from the initial delay, call it after a success
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
+
+// Sleep waits for d, returning false if the context finished first
+func Sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
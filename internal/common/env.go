@@ -0,0 +1,86 @@
+package common
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// helpers for optional env settings, required ones are still checked in the cmd packages
+
+func EnvInt(key string, def int) int {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+
+	parsed, err := strconv.Atoi(val)
+	if err != nil {
+		log.Fatalf("Invalid %s set - int required", key)
+	}
+
+	return parsed
+}
+
+func EnvDuration(key string, def time.Duration) time.Duration {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+
+	parsed, err := time.ParseDuration(val)
+	if err != nil {
+		log.Fatalf("Invalid %s set - duration required (e.g. 5s)", key)
+	}
+
+	return parsed
+}
+
+func EnvBool(key string, def bool) bool {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+
+	parsed, err := strconv.ParseBool(val)
+	if err != nil {
+		log.Fatalf("Invalid %s set - bool required", key)
+	}
+
+	return parsed
+}
+
+func EnvString(key string, def string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+
+	return def
+}
+
+// RetryPolicyFromEnv reads <prefix>_ACK_TIMEOUT and <prefix>_ACK_MAX_ATTEMPTS
+func RetryPolicyFromEnv(prefix string) RetryPolicy {
+	return RetryPolicy{
+		Timeout:     EnvDuration(prefix+"_ACK_TIMEOUT", DefaultRetryPolicy.Timeout),
+		MaxAttempts: EnvInt(prefix+"_ACK_MAX_ATTEMPTS", DefaultRetryPolicy.MaxAttempts),
+	}
+}
+
+// HeartbeatFromEnv reads <prefix>_PING_INTERVAL and <prefix>_PONG_TIMEOUT
+func HeartbeatFromEnv(prefix string) HeartbeatConfig {
+	return HeartbeatConfig{
+		PingInterval: EnvDuration(prefix+"_PING_INTERVAL", DefaultHeartbeat.PingInterval),
+		PongTimeout:  EnvDuration(prefix+"_PONG_TIMEOUT", DefaultHeartbeat.PongTimeout),
+	}.WithDefaults()
+}
+
+// BackoffFromEnv reads <prefix>_BACKOFF_INITIAL and <prefix>_BACKOFF_MAX
+func BackoffFromEnv(prefix string) BackoffConfig {
+	return BackoffConfig{
+		Initial:    EnvDuration(prefix+"_BACKOFF_INITIAL", DefaultBackoff.Initial),
+		Max:        EnvDuration(prefix+"_BACKOFF_MAX", DefaultBackoff.Max),
+		Multiplier: DefaultBackoff.Multiplier,
+		Jitter:     DefaultBackoff.Jitter,
+	}.WithDefaults()
+}
@@ -0,0 +1,157 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// every websocket frame between the server and a controller is an Envelope, the kind says what the payload holds
+type MessageKind string
+
+const (
+	MsgHello     MessageKind = "hello"     // Hello, controller -> server
+	MsgHelloAck  MessageKind = "hello_ack" // HelloAck, server -> controller
+	MsgTask      MessageKind = "task"      // TaskReq, server -> controller
+	MsgResult    MessageKind = "result"    // TaskRes, controller -> server
+	MsgBatch     MessageKind = "batch"     // ResultBatch, controller -> server (batching feature only)
+	MsgAck       MessageKind = "ack"       // TaskAck, both ways
+	MsgHeartbeat MessageKind = "heartbeat" // Heartbeat, both ways
+	MsgInventory MessageKind = "inventory" // Inventory, controller -> server
+	MsgError     MessageKind = "error"     // ErrorMsg, both ways
+	MsgEvent     MessageKind = "event"     // TerminalEvent, controller -> server (events feature only)
+)
+
+var ErrUnknownKind = errors.New("unknown message kind")
+
+func (k MessageKind) MarshalJSON() ([]byte, error) {
+	return json.Marshal(string(k))
+}
+
+func (k *MessageKind) UnmarshalJSON(b []byte) error {
+	var str string
+
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+
+	switch strings.TrimSpace(str) {
+	case string(MsgHello):
+		*k = MsgHello
+	case string(MsgHelloAck):
+		*k = MsgHelloAck
+	case string(MsgTask):
+		*k = MsgTask
+	case string(MsgResult):
+		*k = MsgResult
+	case string(MsgBatch):
+		*k = MsgBatch
+	case string(MsgAck):
+		*k = MsgAck
+	case string(MsgHeartbeat):
+		*k = MsgHeartbeat
+	case string(MsgInventory):
+		*k = MsgInventory
+	case string(MsgError):
+		*k = MsgError
+	case string(MsgEvent):
+		*k = MsgEvent
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownKind, str)
+	}
+
+	return nil
+}
+
+type Envelope struct {
+	Kind    MessageKind     `json:"kind"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// EncodeEnvelope wraps the payload in an envelope of the given kind
+func EncodeEnvelope(kind MessageKind, payload any) ([]byte, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s payload: %v", kind, err)
+	}
+
+	return json.Marshal(Envelope{Kind: kind, Payload: raw})
+}
+
+// DecodeEnvelope reads the envelope without touching the payload, unknown kinds return ErrUnknownKind
+func DecodeEnvelope(data []byte) (Envelope, error) {
+	var env Envelope
+
+	if err := json.Unmarshal(data, &env); err != nil {
+		return Envelope{}, err
+	}
+
+	if env.Kind == "" {
+		return Envelope{}, fmt.Errorf("%w: missing kind", ErrUnknownKind)
+	}
+
+	return env, nil
+}
+
+// Decode unmarshals the payload into v
+func (e Envelope) Decode(v any) error {
+	if err := json.Unmarshal(e.Payload, v); err != nil {
+		return fmt.Errorf("invalid %s payload: %v", e.Kind, err)
+	}
+
+	return nil
+}
+
+// ResultBatch coalesces many small data results into one frame, each result is still acked on its own
+type ResultBatch struct {
+	Results []TaskRes `json:"results"`
+}
+
+type Heartbeat struct {
+	SentAt time.Time `json:"sent_at"`
+}
+
+// InventoryItem is a terminal hosted on a controller
+type InventoryItem struct {
+	TerminalId string       `json:"terminal_id"`
+	Type       TerminalType `json:"terminal_type"`
+	AccountId  int          `json:"account_login"`
+	Server     string       `json:"server"`
+}
+
+// Inventory is the full list of terminals on a controller, sent after connecting
+type Inventory struct {
+	Terminals []InventoryItem `json:"terminals"`
+}
+
+type TerminalEventKind string
+
+const (
+	EventOnline        TerminalEventKind = "online"
+	EventOffline       TerminalEventKind = "offline"
+	EventStale         TerminalEventKind = "stale"          // no message within the stale window, connection dropped
+	EventRestart       TerminalEventKind = "restart"        // watchdog is restarting the terminal
+	EventRestartFailed TerminalEventKind = "restart_failed" // the restart itself failed
+	EventGaveUp        TerminalEventKind = "gave_up"        // out of restarts, needs someone to look at it
+	EventExit          TerminalEventKind = "exit"           // the terminal process ended, with its exit code
+)
+
+// TerminalEvent reports something that happened to a terminal outside of any request
+type TerminalEvent struct {
+	ControllerId string            `json:"controller_id,omitempty"` // filled in by the server
+	TerminalId   string            `json:"terminal_id"`
+	AccountId    int               `json:"account_login"`
+	Server       string            `json:"server"`
+	Kind         TerminalEventKind `json:"kind"`
+	State        string            `json:"state"`
+	Message      string            `json:"message,omitempty"`
+	At           time.Time         `json:"at"`
+}
+
+// ErrorMsg reports a message the peer could not handle
+type ErrorMsg struct {
+	ReqId   int    `json:"request_id,omitempty"`
+	Message string `json:"message"`
+}
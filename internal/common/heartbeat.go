@@ -0,0 +1,32 @@
+package common
+
+import "time"
+
+// HeartbeatConfig controls websocket pings, a peer that stays silent for
+// PingInterval + PongTimeout is considered dead
+type HeartbeatConfig struct {
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+}
+
+var DefaultHeartbeat = HeartbeatConfig{
+	PingInterval: 15 * time.Second,
+	PongTimeout:  10 * time.Second,
+}
+
+// ReadTimeout is how long a read may block before the connection is treated as half-open
+func (h HeartbeatConfig) ReadTimeout() time.Duration {
+	return h.PingInterval + h.PongTimeout
+}
+
+func (h HeartbeatConfig) WithDefaults() HeartbeatConfig {
+	if h.PingInterval <= 0 {
+		h.PingInterval = DefaultHeartbeat.PingInterval
+	}
+
+	if h.PongTimeout <= 0 {
+		h.PongTimeout = DefaultHeartbeat.PongTimeout
+	}
+
+	return h
+}
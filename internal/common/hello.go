@@ -0,0 +1,107 @@
+package common
+
+import (
+	"fmt"
+	"slices"
+)
+
+// ProtocolVersion is bumped on every incompatible change to the controller <-> server messages.
+// Peers speaking anything between MinProtocolVersion and ProtocolVersion can talk to each other
+const (
+	ProtocolVersion    = 2 // v2: every frame is wrapped in an Envelope
+	MinProtocolVersion = 2
+)
+
+// Build is set at link time (-ldflags "-X backend/internal/common.Build=...")
+var Build = "dev"
+
+type Feature string
+
+const (
+	FeatureAckRetry    Feature = "ack_retry"   // acks + resends for requests and responses
+	FeatureDedupe      Feature = "dedupe"      // retried requests are not executed twice
+	FeatureCompression Feature = "compression" // per-message deflate on the websocket
+	FeatureBatching    Feature = "batching"    // data results may arrive as a result_batch
+	FeatureEvents      Feature = "events"      // terminal events are reported to the server
+)
+
+// SupportedFeatures are the optional behaviours this build knows about
+var SupportedFeatures = []Feature{
+	FeatureAckRetry,
+	FeatureDedupe,
+	FeatureCompression,
+	FeatureBatching,
+	FeatureEvents,
+}
+
+// Capabilities is what a controller can do, recorded by the server for routing
+type Capabilities struct {
+	SubTypes      []TaskSubType  `json:"sub_types"`
+	TerminalTypes []TerminalType `json:"terminal_types"`
+	Features      []Feature      `json:"features"`
+}
+
+func (c Capabilities) Supports(subType TaskSubType) bool {
+	return slices.Contains(c.SubTypes, subType)
+}
+
+func (c Capabilities) SupportsTerminal(termType TerminalType) bool {
+	return slices.Contains(c.TerminalTypes, termType)
+}
+
+func (c Capabilities) HasFeature(feature Feature) bool {
+	return slices.Contains(c.Features, feature)
+}
+
+// Hello is the first message a controller sends after the websocket is up
+type Hello struct {
+	ProtocolVersion int    `json:"protocol_version"`
+	ControllerId    string `json:"controller_id"`
+	Capacity        int    `json:"capacity"`
+	Build           string `json:"build"`
+	Capabilities
+}
+
+// HelloAck is the servers answer, features only contains what both sides agreed on
+type HelloAck struct {
+	Accepted        bool      `json:"accepted"`
+	ProtocolVersion int       `json:"protocol_version"`
+	Features        []Feature `json:"features,omitempty"`
+	Reason          string    `json:"reason,omitempty"`
+}
+
+func NewHello(controllerId string, capacity int, caps Capabilities) Hello {
+	return Hello{
+		ProtocolVersion: ProtocolVersion,
+		ControllerId:    controllerId,
+		Capacity:        capacity,
+		Build:           Build,
+		Capabilities:    caps,
+	}
+}
+
+// Negotiate checks the hello against this build and returns the answer to send back.
+// Only features in both the hello and enabled are agreed on
+func Negotiate(hello Hello, enabled []Feature) HelloAck {
+	if hello.ProtocolVersion < MinProtocolVersion {
+		return HelloAck{
+			Reason: fmt.Sprintf("protocol version %d is too old, minimum is %d", hello.ProtocolVersion, MinProtocolVersion),
+		}
+	}
+
+	// newer controllers are expected to fall back to our version
+	version := min(hello.ProtocolVersion, ProtocolVersion)
+
+	features := make([]Feature, 0, len(hello.Features))
+	for _, feature := range hello.Features {
+		if slices.Contains(enabled, feature) {
+			features = append(features, feature)
+		}
+	}
+
+	return HelloAck{
+		Accepted:        true,
+		ProtocolVersion: version,
+		Features:        features,
+	}
+}
@@ -0,0 +1,136 @@
+package common
+
+import "context"
+
+// Priority orders traffic so a backlog of bulk data never delays a copy signal
+type Priority int
+
+const (
+	PriorityMasterTrade Priority = iota // trade events from master accounts (copy signals)
+	PrioritySlaveTrade                  // trade results from slave accounts
+	PriorityAccount                     // account data and everything else
+	PriorityBulk                        // price data
+	numPriorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityMasterTrade:
+		return "master_trade"
+	case PrioritySlaveTrade:
+		return "slave_trade"
+	case PriorityAccount:
+		return "account"
+	case PriorityBulk:
+		return "bulk"
+	default:
+		return "unknown"
+	}
+}
+
+// ResultPriority picks the lane for a task result
+func ResultPriority(res TaskRes) Priority {
+	master := res.MiscDetails != nil && res.MiscDetails.Master
+
+	switch TaskSubType(res.ReqSubType) {
+	case DataTaskPrice, DataTaskPriceFeed:
+		return PriorityBulk
+	case DataTaskTrades:
+		// a masters trade snapshot is what the copier reacts to
+		if master {
+			return PriorityMasterTrade
+		}
+		return PriorityAccount
+	}
+
+	if res.ReqType == string(TradeTask) {
+		if master {
+			return PriorityMasterTrade
+		}
+		return PrioritySlaveTrade
+	}
+
+	return PriorityAccount
+}
+
+// Lanes is a set of bounded queues drained in strict priority order
+type Lanes[T any] struct {
+	lanes    [numPriorities]chan T
+	classify func(T) Priority
+}
+
+func NewLanes[T any](size int, classify func(T) Priority) *Lanes[T] {
+	l := &Lanes[T]{classify: classify}
+	for i := range l.lanes {
+		l.lanes[i] = make(chan T, size)
+	}
+
+	return l
+}
+
+// Push queues the item on its lane, blocking while that lane is full so producers feel the backpressure
+func (l *Lanes[T]) Push(ctx context.Context, item T) bool {
+	p := l.classify(item)
+	if p < 0 || p >= numPriorities {
+		p = PriorityAccount
+	}
+
+	select {
+	case l.lanes[p] <- item:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Next returns the oldest item of the highest priority lane that has one, blocking while all are empty
+func (l *Lanes[T]) Next(ctx context.Context) (T, bool) {
+	for _, lane := range l.lanes {
+		select {
+		case item := <-lane:
+			return item, true
+		default:
+		}
+	}
+
+	var zero T
+	select {
+	case <-ctx.Done():
+		return zero, false
+	case item := <-l.lanes[PriorityMasterTrade]:
+		return item, true
+	case item := <-l.lanes[PrioritySlaveTrade]:
+		return item, true
+	case item := <-l.lanes[PriorityAccount]:
+		return item, true
+	case item := <-l.lanes[PriorityBulk]:
+		return item, true
+	}
+}
+
+// Pump feeds out in priority order, for consumers that need to select on a single channel.
+// At most one item is held back while out is busy
+func (l *Lanes[T]) Pump(ctx context.Context, out chan<- T) {
+	for {
+		item, ok := l.Next(ctx)
+		if !ok {
+			return
+		}
+
+		select {
+		case out <- item:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Len is the number of queued items per lane
+func (l *Lanes[T]) Len() [numPriorities]int {
+	var lens [numPriorities]int
+	for i, lane := range l.lanes {
+		lens[i] = len(lane)
+	}
+
+	return lens
+}
@@ -3,7 +3,10 @@ package common
 import (
 	"encoding/json"
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type ControllerConfig struct {
@@ -12,6 +15,101 @@ type ControllerConfig struct {
 	ServerWsUrl       string
 	TerminalRawTcpUrl string
 	Capacity          int
+	DataDir           string      // persistent controller state (outbox, etc.)
+	AckRetry          RetryPolicy // resend policy for responses the server has not acked
+	DedupeWindow      int         // how many recent request ids are remembered to drop retried tasks
+	Heartbeat         HeartbeatConfig
+	Reconnect         BackoffConfig // delays between attempts to reach the server
+	Compression       bool          // ask the server for per-message deflate
+	Batching          BatchConfig
+	ResponseFileTTL   time.Duration // result files the EA stored are removed after this even if never acked
+	TerminalQueue     TerminalQueueConfig
+	TerminalFraming   TerminalFramingConfig
+	TerminalListen    TerminalListenConfig
+	Watchdog          WatchdogConfig
+	TerminalRuntime   string // raw, podman or fake, deployments can pick another one
+	Podman            PodmanConfig
+	Supervisor        SupervisorConfig
+	BasesDir          string // versioned mt4/mt5 installs new terminals are cloned from
+}
+
+// BatchConfig controls coalescing of data results into a single frame, trade results are never batched
+type BatchConfig struct {
+	FlushWindow time.Duration // max time a result waits in a batch, 0 disables batching
+	MaxItems    int
+	MaxBytes    int
+}
+
+func (b BatchConfig) Enabled() bool {
+	return b.FlushWindow > 0
+}
+
+// OverflowPolicy decides what happens to a task sent to a terminal whose queue is full
+type OverflowPolicy string
+
+const (
+	OverflowReject         OverflowPolicy = "reject"           // fail the new task
+	OverflowDropOldestData OverflowPolicy = "drop_oldest_data" // make room by dropping the oldest queued data task, trades are never dropped
+)
+
+// TerminalQueueConfig bounds the tasks waiting to be written to each terminal
+type TerminalQueueConfig struct {
+	Size     int
+	Overflow OverflowPolicy
+}
+
+// TerminalFramingConfig limits what EAs can send on the terminal socket
+type TerminalFramingConfig struct {
+	MaxFrameSize int  // bytes, larger messages drop the connection
+	AllowFramed  bool // length prefixed frames with a checksum, when the EA supports them
+}
+
+// TerminalListenConfig adds unix socket transports next to TerminalRawTcpUrl
+type TerminalListenConfig struct {
+	UnixSocket        string      // shared socket path, empty disables it
+	PerTerminalSocket bool        // a socket in every terminal dir that only that terminal may use
+	SocketMode        os.FileMode // permissions of the socket files
+}
+
+// WatchdogConfig drives the terminal liveness checks, a zero Interval disables them
+type WatchdogConfig struct {
+	Interval     time.Duration // how often terminals get a heartbeat task
+	StaleAfter   time.Duration // silence before an online terminal's connection is dropped
+	RestartAfter time.Duration // time offline before the terminal is restarted
+	MaxRestarts  int           // restarts in a row before giving up, reset once the terminal is back online
+}
+
+// PodmanConfig is used by the podman terminal runtime, Binary can point at a fake podman on CI
+type PodmanConfig struct {
+	Binary  string // podman executable, defaults to podman on the PATH
+	Image   string // image with wine and the terminal runtime, the terminal dir is mounted into it
+	Network string // container network, host by default so the EA reaches the controller on localhost
+}
+
+// SupervisorConfig controls the crash restarts of raw terminal processes
+type SupervisorConfig struct {
+	Backoff     BackoffConfig // delay between a crash and the relaunch
+	MaxCrashes  int           // crashes in a row before the terminal is left failed
+	StableAfter time.Duration // a run this long resets the crash count
+	MaxLogSize  int64         // terminal log size that gets rotated on the next launch
+}
+
+type ServerConfig struct {
+	Addr           string
+	AckRetry       RetryPolicy   // resend policy for requests a controller has not acked
+	RequestTimeout time.Duration // default time to wait for a controller response
+	Heartbeat      HeartbeatConfig
+	Compression    bool // allow per-message deflate with controllers that ask for it
+}
+
+// Features are the optional features the server agrees to during the hello
+func (conf ServerConfig) Features() []Feature {
+	features := []Feature{FeatureAckRetry, FeatureDedupe, FeatureBatching, FeatureEvents}
+	if conf.Compression {
+		features = append(features, FeatureCompression)
+	}
+
+	return features
 }
 
 type TerminalType string
@@ -96,15 +194,18 @@ const (
 	AccountTaskStop    TaskSubType = "acc_stop"
 	AccountTaskRestart TaskSubType = "acc_restart"
 	AccountTaskDelete  TaskSubType = "acc_delete"
+	AccountTaskUnload  TaskSubType = "acc_unload" // controller -> EA only, remove the EA and close its charts before a stop
 
-	TradeTaskAdd TaskSubType = "trade_add"
-	TradeTaskMod TaskSubType = "trade_modify"
+	TradeTaskAdd    TaskSubType = "trade_add"
+	TradeTaskMod    TaskSubType = "trade_modify"
+	TradeTaskStatus TaskSubType = "trade_status" // controller -> EA only, asks whether a trade request was already seen
 
 	DataTaskSymbol    TaskSubType = "dt_symbol"
 	DataTaskPrice     TaskSubType = "dt_price"
 	DataTaskAccount   TaskSubType = "dt_account"
 	DataTaskTrades    TaskSubType = "dt_trades"
 	DataTaskPriceFeed TaskSubType = "dt_price_feed"
+	DataTaskHeartbeat TaskSubType = "dt_heartbeat" // controller -> EA liveness probe, answered but never forwarded
 
 	ControllerTaskShutdown          TaskSubType = "ctrl_shutdown"
 	ControllerTaskUpdateMt4Base     TaskSubType = "ctrl_update_mt4"
@@ -134,11 +235,15 @@ func (t *TaskSubType) UnmarshalJSON(b []byte) error {
 		*t = AccountTaskDelete
 	case string(AccountTaskRestart):
 		*t = AccountTaskRestart
+	case string(AccountTaskUnload):
+		*t = AccountTaskUnload
 
 	case string(TradeTaskAdd):
 		*t = TradeTaskAdd
 	case string(TradeTaskMod):
 		*t = TradeTaskMod
+	case string(TradeTaskStatus):
+		*t = TradeTaskStatus
 
 	case string(DataTaskSymbol):
 		*t = DataTaskSymbol
@@ -150,6 +255,8 @@ func (t *TaskSubType) UnmarshalJSON(b []byte) error {
 		*t = DataTaskTrades
 	case string(DataTaskPriceFeed):
 		*t = DataTaskPriceFeed
+	case string(DataTaskHeartbeat):
+		*t = DataTaskHeartbeat
 
 	case string(ControllerTaskShutdown):
 		*t = ControllerTaskShutdown
@@ -192,6 +299,13 @@ type TerminalMiscData struct {
 	IntervalSec   int    `json:"interval_seconds,omitempty"`
 	IntervalStart int    `json:"interval_start,omitempty"`
 	IntervalEnd   int    `json:"interval_end,omitempty"`
+	Master        bool   `json:"master,omitempty"` // set by the server for master accounts, results from them jump the queue
+}
+
+// AccountKey identifies an account (login + broker server) on the server and the controllers alike,
+// broker server names are not case sensitive
+func AccountKey(login int, server string) string {
+	return strconv.Itoa(login) + "@" + strings.ToLower(strings.TrimSpace(server))
 }
 
 type TaskReq struct {
@@ -223,6 +337,24 @@ type TradeExecTaskPayload struct {
 	Comment    string `json:"comment"`
 }
 
+// BaseUpdatePayload is the payload of ctrl_update_mt4/ctrl_update_mt5. The url (http(s) or a local path)
+// points at a zip of the terminal install, an already staged version needs neither url nor sha256
+type BaseUpdatePayload struct {
+	Version string `json:"version"`
+	Url     string `json:"url,omitempty"`
+	Sha256  string `json:"sha256,omitempty"`
+}
+
+// AccountStopPayload is the optional payload of acc_stop, a full stop also removes the terminal's pod
+type AccountStopPayload struct {
+	Full bool `json:"full"`
+}
+
+// TradeStatusPayload is the EAs answer to a trade_status query for the same request id
+type TradeStatusPayload struct {
+	Seen bool `json:"seen"` // the EA received the request, its result is on the way
+}
+
 type TaskRes struct {
 	ReqId       int               `json:"request_id"`
 	ReqType     string            `json:"type"`
@@ -230,6 +362,7 @@ type TaskRes struct {
 	MiscDetails *TerminalMiscData `json:"misc,omitempty"`
 	Err         string            `json:"error"`
 	Payload     []byte            `json:"payload"`
+	Seq         uint64            `json:"seq,omitempty"` // controller outbox sequence echoed in the ack, 0 when the result was not persisted
 }
 
 func (tr *TaskRes) TradeResToTradeReq() (req *TradeExecTaskPayload, err error) {
@@ -2,18 +2,21 @@ package controller
 
 import (
 	"backend/internal/common"
+	controllertasks "backend/internal/controller/controller_tasks"
 	servercomms "backend/internal/controller/server_comms"
 	"backend/internal/controller/terminal"
 	"context"
+	"path/filepath"
 )
 
 type Controller struct {
 	TerminalComms *terminal.TerminalConnector
 	ServerComms   *servercomms.ServerConnector
+	Tasks         *controllertasks.TaskHandler
 }
 
 func NewController(conf common.ControllerConfig) (*Controller, error) {
-	termComms, err := terminal.NewTerminalConnector(conf.TerminalRawTcpUrl)
+	termComms, err := terminal.NewTerminalConnector(conf)
 	if err != nil {
 		return nil, err
 	}
@@ -23,17 +26,72 @@ func NewController(conf common.ControllerConfig) (*Controller, error) {
 		return nil, err
 	}
 
+	dedupe, err := controllertasks.OpenDedupe(filepath.Join(conf.DataDir, "dedupe.log"), conf.DedupeWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := controllertasks.NewTaskHandler(termComms, wsServer.Responses(), wsServer.Outbox(), dedupe)
+
+	features := []common.Feature{common.FeatureAckRetry, common.FeatureDedupe}
+	if conf.Compression {
+		features = append(features, common.FeatureCompression)
+	}
+	if conf.Batching.Enabled() {
+		features = append(features, common.FeatureBatching)
+	}
+	features = append(features, common.FeatureEvents)
+
+	wsServer.SetCapabilities(common.Capabilities{
+		SubTypes:      tasks.SupportedSubTypes(),
+		TerminalTypes: []common.TerminalType{common.MT4, common.MT5},
+		Features:      features,
+	})
+
 	return &Controller{
 		TerminalComms: termComms,
 		ServerComms:   wsServer,
+		Tasks:         tasks,
 	}, nil
 }
 
 func (ctrl *Controller) Run(ctx context.Context) error {
 	go ctrl.TerminalComms.Run(ctx)
+	go ctrl.Tasks.Run(ctx, ctrl.ServerComms.Requests())
+	go ctrl.watchServerLink(ctx)
+	go ctrl.forwardEvents(ctx)
 	return ctrl.ServerComms.Start(ctx)
 }
 
+// watchServerLink pauses terminal dispatch whenever the server link is not ready
+func (ctrl *Controller) watchServerLink(ctx context.Context) {
+	states, unsubscribe := ctrl.ServerComms.Subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case state := <-states:
+			ctrl.Tasks.SetLinkReady(state == servercomms.StateReady)
+		}
+	}
+}
+
+// forwardEvents passes terminal events on to the server
+func (ctrl *Controller) forwardEvents(ctx context.Context) {
+	events := ctrl.TerminalComms.Events()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			ctrl.ServerComms.SendEvent(event)
+		}
+	}
+}
+
 /**
 dispatcher
 registry (list of terminals)
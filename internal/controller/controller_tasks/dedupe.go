@@ -0,0 +1,244 @@
+package controllertasks
+
+import (
+	"backend/internal/common"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type dedupeRecord struct {
+	ReqId      int             `json:"request_id"`
+	ReqType    string          `json:"type,omitempty"`
+	ReqSubType string          `json:"sub_type,omitempty"`
+	Res        *common.TaskRes `json:"res,omitempty"` // nil while the task is still running
+}
+
+// Dedupe remembers the most recent request ids so retried requests are not executed twice.
+// Entries are appended to a log so the window survives restarts, oldest ids fall out first
+type Dedupe struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	capacity int
+	order    []int // request ids, oldest first
+	entries  map[int]dedupeRecord
+	records  int
+}
+
+func OpenDedupe(path string, capacity int) (*Dedupe, error) {
+	if capacity <= 0 {
+		capacity = 4096
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("[dedupe] failed to create dir: %v", err)
+	}
+
+	d := &Dedupe{
+		path:     path,
+		capacity: capacity,
+		entries:  make(map[int]dedupeRecord),
+	}
+
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+
+	if err := d.compact(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *Dedupe) load() error {
+	file, err := os.Open(d.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("[dedupe] failed to open log: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var rec dedupeRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			log.Printf("[dedupe] skipping corrupt record: %v", err)
+			continue
+		}
+
+		d.apply(rec)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("[dedupe] failed to read log: %v", err)
+	}
+
+	// nothing is running right after a start, a retry of these gets an error instead of waiting forever.
+	// Not re-run since a trade may have gone through before the crash
+	interrupted := 0
+	for _, reqId := range d.order {
+		rec := d.entries[reqId]
+		if rec.Res == nil {
+			rec.Res = &common.TaskRes{
+				ReqId:      reqId,
+				ReqType:    rec.ReqType,
+				ReqSubType: rec.ReqSubType,
+				Err:        "interrupted by controller restart",
+			}
+			d.entries[reqId] = rec
+			interrupted++
+		}
+	}
+	if interrupted > 0 {
+		log.Printf("[dedupe] %d requests were still running at the last shutdown, failing them", interrupted)
+	}
+
+	return nil
+}
+
+func (d *Dedupe) apply(rec dedupeRecord) {
+	if _, ok := d.entries[rec.ReqId]; !ok {
+		d.order = append(d.order, rec.ReqId)
+	}
+	d.entries[rec.ReqId] = rec
+
+	for len(d.order) > d.capacity {
+		delete(d.entries, d.order[0])
+		d.order = d.order[1:]
+	}
+}
+
+// Begin marks the request as running. If it was seen before, seen is true and cached holds
+// the last result we sent for it (nil when it is still running)
+func (d *Dedupe) Begin(task common.TaskReq) (cached *common.TaskRes, seen bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if rec, ok := d.entries[task.Id]; ok {
+		return rec.Res, true
+	}
+
+	rec := dedupeRecord{ReqId: task.Id, ReqType: string(task.ReqType), ReqSubType: string(task.ReqSubType)}
+	if err := d.write(rec, true); err != nil {
+		log.Printf("[dedupe] failed to persist request %d: %v", task.Id, err)
+	}
+
+	return nil, false
+}
+
+// Complete caches the result so a retry of the request gets it back instead of a re-run.
+// Only the first result is synced, later ones (repeating data requests) just replace it
+func (d *Dedupe) Complete(res common.TaskRes) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res.Seq = 0
+	prev, ok := d.entries[res.ReqId]
+	rec := dedupeRecord{ReqId: res.ReqId, ReqType: res.ReqType, ReqSubType: res.ReqSubType, Res: &res}
+
+	if err := d.write(rec, !ok || prev.Res == nil); err != nil {
+		log.Printf("[dedupe] failed to persist result %d: %v", res.ReqId, err)
+	}
+}
+
+// write appends and applies the record, sync waits for it to reach the disk (caller holds the lock)
+func (d *Dedupe) write(rec dedupeRecord, sync bool) error {
+	d.apply(rec)
+
+	if d.file == nil {
+		return fmt.Errorf("[dedupe] log is closed")
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := d.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	if sync {
+		if err := d.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	d.records++
+	if d.records > 2*d.capacity {
+		return d.compact()
+	}
+
+	return nil
+}
+
+// compact rewrites the log with only the current window (caller holds the lock)
+func (d *Dedupe) compact() error {
+	tmpPath := d.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("[dedupe] failed to create compacted log: %v", err)
+	}
+
+	writer := bufio.NewWriter(tmp)
+	for _, reqId := range d.order {
+		data, err := json.Marshal(d.entries[reqId])
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("[dedupe] failed to marshal record: %v", err)
+		}
+		writer.Write(append(data, '\n'))
+	}
+
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("[dedupe] failed to write compacted log: %v", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("[dedupe] failed to sync compacted log: %v", err)
+	}
+	tmp.Close()
+
+	if d.file != nil {
+		d.file.Close()
+		d.file = nil
+	}
+
+	if err := os.Rename(tmpPath, d.path); err != nil {
+		return fmt.Errorf("[dedupe] failed to replace log: %v", err)
+	}
+
+	file, err := os.OpenFile(d.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("[dedupe] failed to reopen log: %v", err)
+	}
+
+	d.file = file
+	d.records = len(d.order)
+	return nil
+}
+
+func (d *Dedupe) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.file == nil {
+		return nil
+	}
+
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
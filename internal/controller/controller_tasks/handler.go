@@ -2,28 +2,312 @@ package controllertasks
 
 import (
 	"backend/internal/common"
+	"backend/internal/controller/outbox"
 	"backend/internal/controller/terminal"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
 )
 
 type TaskHandler struct {
-	registry *terminal.TerminalConnector
+	registry  *terminal.TerminalConnector
+	responses *common.Lanes[common.TaskRes] // results headed back to the server
+	outbox    *outbox.Outbox                // results are stored here before they are queued
+	dedupe    *Dedupe                       // recently seen request ids so retries are not executed twice
+	ctx       context.Context
+
+	// closed while the server link is ready, terminal dispatch waits on it
+	linkMu sync.Mutex
+	linkUp chan struct{}
 }
 
-func NewTaskHandler(registry *terminal.TerminalConnector) *TaskHandler {
+func NewTaskHandler(registry *terminal.TerminalConnector, responses *common.Lanes[common.TaskRes], ob *outbox.Outbox, dedupe *Dedupe) *TaskHandler {
 	return &TaskHandler{
-		registry: registry,
+		registry:  registry,
+		responses: responses,
+		outbox:    ob,
+		dedupe:    dedupe,
+		linkUp:    make(chan struct{}),
+	}
+}
+
+// SetLinkReady pauses or resumes terminal dispatch, results can't reach the server while the link is down
+func (th *TaskHandler) SetLinkReady(ready bool) {
+	th.linkMu.Lock()
+	defer th.linkMu.Unlock()
+
+	select {
+	case <-th.linkUp:
+		if !ready {
+			th.linkUp = make(chan struct{})
+		}
+	default:
+		if ready {
+			close(th.linkUp)
+		}
+	}
+}
+
+func (th *TaskHandler) waitForLink() bool {
+	th.linkMu.Lock()
+	linkUp := th.linkUp
+	th.linkMu.Unlock()
+
+	select {
+	case <-linkUp:
+		return true
+	case <-th.ctx.Done():
+		return false
+	}
+}
+
+// Run consumes the tasks forwarded by the server connection until the context is done
+func (th *TaskHandler) Run(ctx context.Context, requests <-chan common.TaskReq) {
+	th.ctx = ctx
+
+	go th.collectResponses(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case task := <-requests:
+			th.handleTaskRequest(task)
+		}
+	}
+}
+
+// collectResponses forwards terminal results to the server, Respond blocks while the lanes are full
+func (th *TaskHandler) collectResponses(ctx context.Context) {
+	responses := th.registry.Responses()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case res := <-responses:
+			if res.ReqId == 0 {
+				// unsolicited updates (trade changes etc.) have no request to dedupe against
+				th.forward(res)
+				continue
+			}
+
+			th.Respond(res)
+		}
+	}
+}
+
+// SupportedSubTypes lists the tasks this controller can handle, advertised in the server hello
+func (th *TaskHandler) SupportedSubTypes() []common.TaskSubType {
+	return []common.TaskSubType{
+		common.AccountTaskCreate,
+		common.AccountTaskStart,
+		common.AccountTaskStop,
+		common.AccountTaskRestart,
+
+		common.ControllerTaskUpdateMt4Base,
+		common.ControllerTaskUpdateMt5Base,
+
+		common.TradeTaskAdd,
+		common.TradeTaskMod,
+
+		common.DataTaskSymbol,
+		common.DataTaskPrice,
+		common.DataTaskAccount,
+		common.DataTaskTrades,
+		common.DataTaskPriceFeed,
 	}
 }
 
 func (th *TaskHandler) handleTaskRequest(task common.TaskReq) {
-	if task.ReqType == common.AckTask {
-		// delete the file
-	} else if _, ok := common.TerminalTasks[task.ReqType]; ok {
+	if cached, seen := th.dedupe.Begin(task); seen {
+		if cached == nil {
+			log.Printf("[ctrl] request %d already in progress, ignoring retry", task.Id)
+			return
+		}
+
+		log.Printf("[ctrl] request %d already handled, resending result", task.Id)
+		th.forward(*cached)
+		return
+	}
+
+	if _, ok := common.TerminalTasks[task.ReqType]; ok {
 		// handle terminal related tasks
-		th.registry.SendToTerminal(task)
+		if !th.waitForLink() {
+			return
+		}
+
+		if err := th.registry.SendToTerminal(task); err != nil {
+			th.respondErr(task, err)
+		}
 	} else if task.ReqType == common.AccountTask {
 		// handle the account related tasks
+		switch task.ReqSubType {
+		case common.AccountTaskCreate:
+			// deploying takes a while, don't hold up the other tasks
+			go th.createAccount(task)
+		case common.AccountTaskStart, common.AccountTaskStop, common.AccountTaskRestart:
+			// these block until the terminal is up or down
+			go th.terminalLifecycle(task)
+		default:
+			th.respondErr(task, fmt.Errorf("[ctrl] unsupported account task %s", task.ReqSubType))
+		}
 	} else {
 		// handle controller related tasks
+		switch task.ReqSubType {
+		case common.ControllerTaskUpdateMt4Base, common.ControllerTaskUpdateMt5Base:
+			// downloads and copies files, can take minutes
+			go th.updateBase(task)
+		default:
+			th.respondErr(task, fmt.Errorf("[ctrl] unsupported task %s/%s", task.ReqType, task.ReqSubType))
+		}
+	}
+}
+
+// Respond sends a task result to the server and caches it for retries of the same request,
+// price feeds are outdated by the next tick so a retry just gets the next one
+func (th *TaskHandler) Respond(res common.TaskRes) {
+	if durable(res) {
+		th.dedupe.Complete(res)
 	}
+	th.forward(res)
+}
+
+func (th *TaskHandler) forward(res common.TaskRes) {
+	// stored before queuing so results produced while the link is down survive a restart
+	if durable(res) {
+		seq, err := th.outbox.Append(res)
+		if err != nil {
+			log.Printf("[ctrl] failed to persist response %d: %v", res.ReqId, err)
+		}
+		res.Seq = seq
+	}
+
+	if !th.responses.Push(th.ctx, res) {
+		log.Printf("[ctrl] dropping response %d, shutting down", res.ReqId)
+	}
+}
+
+// durable results go through the outbox. Price feed ticks are outdated by the next one,
+// syncing each of them to disk would cost more than losing a few
+func durable(res common.TaskRes) bool {
+	return common.TaskSubType(res.ReqSubType) != common.DataTaskPriceFeed
+}
+
+func (th *TaskHandler) respondErr(task common.TaskReq, err error) {
+	th.Respond(common.TaskRes{
+		ReqId:       task.Id,
+		ReqType:     string(task.ReqType),
+		ReqSubType:  string(task.ReqSubType),
+		MiscDetails: task.MiscDetails,
+		Err:         err.Error(),
+	})
+}
+
+func (th *TaskHandler) createAccount(task common.TaskReq) {
+	var details terminal.TerminalDeploy
+	if err := json.Unmarshal(task.Payload, &details); err != nil {
+		th.respondErr(task, fmt.Errorf("[ctrl] invalid deploy payload: %v", err))
+		return
+	}
+
+	// the server marks copy masters on the task
+	if task.MiscDetails != nil && task.MiscDetails.Master {
+		details.Master = true
+	}
+
+	term, err := th.registry.Register(details)
+	if err != nil {
+		th.respondErr(task, err)
+		return
+	}
+
+	th.respondInfo(task, term)
+}
+
+// terminalLifecycle starts, stops or restarts a terminal and answers with its info once it's done
+func (th *TaskHandler) terminalLifecycle(task common.TaskReq) {
+	var (
+		term *terminal.Terminal
+		err  error
+	)
+
+	switch task.ReqSubType {
+	case common.AccountTaskStart:
+		term, err = th.registry.StartTerminal(task.MiscDetails)
+	case common.AccountTaskRestart:
+		term, err = th.registry.RestartTerminal(task.MiscDetails)
+	case common.AccountTaskStop:
+		var stop common.AccountStopPayload
+		if len(task.Payload) > 0 {
+			if err := json.Unmarshal(task.Payload, &stop); err != nil {
+				th.respondErr(task, fmt.Errorf("[ctrl] invalid stop payload: %v", err))
+				return
+			}
+		}
+
+		term, err = th.registry.StopTerminal(task.MiscDetails, stop.Full)
+	}
+
+	if err != nil {
+		th.respondErr(task, err)
+		return
+	}
+
+	th.respondInfo(task, term)
+}
+
+func (th *TaskHandler) updateBase(task common.TaskReq) {
+	var update common.BaseUpdatePayload
+	if err := json.Unmarshal(task.Payload, &update); err != nil {
+		th.respondErr(task, fmt.Errorf("[ctrl] invalid base update payload: %v", err))
+		return
+	}
+
+	termType := common.MT5
+	if task.ReqSubType == common.ControllerTaskUpdateMt4Base {
+		termType = common.MT4
+	}
+
+	result, err := th.registry.UpdateBase(termType, update)
+	if err != nil {
+		th.respondErr(task, err)
+		return
+	}
+
+	payload, err := json.Marshal(result)
+	if err != nil {
+		th.respondErr(task, err)
+		return
+	}
+
+	th.Respond(common.TaskRes{
+		ReqId:      task.Id,
+		ReqType:    string(task.ReqType),
+		ReqSubType: string(task.ReqSubType),
+		Payload:    payload,
+	})
+}
+
+func (th *TaskHandler) respondInfo(task common.TaskReq, term *terminal.Terminal) {
+	info := term.Info()
+	payload, err := json.Marshal(info)
+	if err != nil {
+		th.respondErr(task, err)
+		return
+	}
+
+	th.Respond(common.TaskRes{
+		ReqId:      task.Id,
+		ReqType:    string(task.ReqType),
+		ReqSubType: string(task.ReqSubType),
+		MiscDetails: &common.TerminalMiscData{
+			TerminalId: info.Id,
+			AccountId:  info.Login,
+			Server:     info.Server,
+		},
+		Payload: payload,
+	})
 }
@@ -0,0 +1,283 @@
+package outbox
+
+import (
+	"backend/internal/common"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	opAdd = "add"
+	opAck = "ack"
+
+	// once the log has this many more records than pending responses we rewrite it
+	compactThreshold = 1024
+)
+
+type record struct {
+	Op    string          `json:"op"`
+	Seq   uint64          `json:"seq,omitempty"`
+	ReqId int             `json:"request_id,omitempty"`
+	Res   *common.TaskRes `json:"res,omitempty"`
+}
+
+// Outbox is an append-only log of task responses that the server has not acked yet.
+// Every response is written (and synced) before it is sent so nothing is lost if the
+// websocket drops or the controller restarts. Pending responses are replayed in the
+// order they were appended.
+type Outbox struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	nextSeq uint64
+	pending map[uint64]common.TaskRes
+	records int // number of records in the log file, used to decide when to compact
+}
+
+func Open(path string) (*Outbox, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("[outbox] failed to create dir: %v", err)
+	}
+
+	ob := &Outbox{
+		path:    path,
+		nextSeq: 1, // 0 marks results that were never stored
+		pending: make(map[uint64]common.TaskRes),
+	}
+
+	if err := ob.load(); err != nil {
+		return nil, err
+	}
+
+	// always start from a compacted log, this also drops any partially written record
+	if err := ob.compact(); err != nil {
+		return nil, err
+	}
+
+	return ob, nil
+}
+
+func (ob *Outbox) load() error {
+	file, err := os.Open(ob.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("[outbox] failed to open log: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			log.Printf("[outbox] skipping corrupt record: %v", err)
+			continue
+		}
+
+		ob.apply(rec)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("[outbox] failed to read log: %v", err)
+	}
+
+	return nil
+}
+
+func (ob *Outbox) apply(rec record) {
+	switch rec.Op {
+	case opAdd:
+		if rec.Res == nil {
+			return
+		}
+		ob.pending[rec.Seq] = *rec.Res
+		if rec.Seq >= ob.nextSeq {
+			ob.nextSeq = rec.Seq + 1
+		}
+	case opAck:
+		if rec.Seq != 0 {
+			delete(ob.pending, rec.Seq)
+			return
+		}
+
+		// servers that don't echo the sequence ack the whole request
+		for seq, res := range ob.pending {
+			if res.ReqId == rec.ReqId {
+				delete(ob.pending, seq)
+			}
+		}
+	}
+}
+
+// Append stores the response and returns its sequence once it has been synced to disk
+func (ob *Outbox) Append(res common.TaskRes) (uint64, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	res.Seq = 0
+	rec := record{Op: opAdd, Seq: ob.nextSeq, Res: &res}
+	if err := ob.write(rec); err != nil {
+		return 0, err
+	}
+
+	ob.apply(rec)
+	return rec.Seq, nil
+}
+
+// Has reports whether the response appended as seq is still waiting for its ack
+func (ob *Outbox) Has(seq uint64) bool {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	_, ok := ob.pending[seq]
+	return ok
+}
+
+// Ack removes the response appended as seq, or every pending response of the request when seq is 0
+func (ob *Outbox) Ack(reqId int, seq uint64) error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	rec := record{Op: opAck, Seq: seq, ReqId: reqId}
+	if err := ob.write(rec); err != nil {
+		return err
+	}
+
+	ob.apply(rec)
+
+	if len(ob.pending) == 0 || ob.records-len(ob.pending) > compactThreshold {
+		return ob.compact()
+	}
+
+	return nil
+}
+
+// Pending returns a copy of all unacked responses in the order they were appended
+func (ob *Outbox) Pending() []common.TaskRes {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	seqs := make([]uint64, 0, len(ob.pending))
+	for seq := range ob.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	responses := make([]common.TaskRes, 0, len(seqs))
+	for _, seq := range seqs {
+		res := ob.pending[seq]
+		res.Seq = seq
+		responses = append(responses, res)
+	}
+
+	return responses
+}
+
+func (ob *Outbox) Len() int {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	return len(ob.pending)
+}
+
+func (ob *Outbox) write(rec record) error {
+	if ob.file == nil {
+		return fmt.Errorf("[outbox] log is closed")
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("[outbox] failed to marshal record: %v", err)
+	}
+
+	if _, err := ob.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("[outbox] failed to write record: %v", err)
+	}
+
+	if err := ob.file.Sync(); err != nil {
+		return fmt.Errorf("[outbox] failed to sync log: %v", err)
+	}
+
+	ob.records++
+	return nil
+}
+
+// compact rewrites the log with only the pending responses (caller holds the lock)
+func (ob *Outbox) compact() error {
+	tmpPath := ob.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("[outbox] failed to create compacted log: %v", err)
+	}
+
+	seqs := make([]uint64, 0, len(ob.pending))
+	for seq := range ob.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	writer := bufio.NewWriter(tmp)
+	for _, seq := range seqs {
+		res := ob.pending[seq]
+		data, err := json.Marshal(record{Op: opAdd, Seq: seq, Res: &res})
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("[outbox] failed to marshal record: %v", err)
+		}
+		writer.Write(append(data, '\n'))
+	}
+
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("[outbox] failed to write compacted log: %v", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("[outbox] failed to sync compacted log: %v", err)
+	}
+	tmp.Close()
+
+	if ob.file != nil {
+		ob.file.Close()
+		ob.file = nil
+	}
+
+	if err := os.Rename(tmpPath, ob.path); err != nil {
+		// keep appending to the old log, the next compaction tries again
+		if file, reopenErr := os.OpenFile(ob.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); reopenErr == nil {
+			ob.file = file
+		}
+		return fmt.Errorf("[outbox] failed to replace log: %v", err)
+	}
+
+	file, err := os.OpenFile(ob.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("[outbox] failed to reopen log: %v", err)
+	}
+
+	ob.file = file
+	ob.records = len(seqs)
+	return nil
+}
+
+func (ob *Outbox) Close() error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if ob.file == nil {
+		return nil
+	}
+
+	err := ob.file.Close()
+	ob.file = nil
+	return err
+}
@@ -0,0 +1,74 @@
+package servercomms
+
+import (
+	"backend/internal/common"
+	"encoding/json"
+	"time"
+)
+
+// batcher collects data results until the flush window passes or a size limit is hit
+type batcher struct {
+	conf    common.BatchConfig
+	results []common.TaskRes
+	size    int
+	timer   *time.Timer
+}
+
+func newBatcher(conf common.BatchConfig) *batcher {
+	if conf.MaxItems <= 0 {
+		conf.MaxItems = 500
+	}
+
+	if conf.MaxBytes <= 0 {
+		conf.MaxBytes = 512 * 1024
+	}
+
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	return &batcher{
+		conf:  conf,
+		timer: timer,
+	}
+}
+
+// batchable decides which results may wait in a batch, trade (and other low volume) results always go out straight away
+func batchable(res common.TaskRes) bool {
+	return res.ReqType == string(common.DataTask)
+}
+
+// add queues the result and reports whether the batch should be flushed now
+func (b *batcher) add(res common.TaskRes) bool {
+	size := len(res.Payload)
+	if data, err := json.Marshal(res); err == nil {
+		size = len(data)
+	}
+
+	if len(b.results) == 0 {
+		// the window starts with the oldest result so none of them wait longer than it
+		b.timer.Reset(b.conf.FlushWindow)
+	}
+
+	b.results = append(b.results, res)
+	b.size += size
+
+	return len(b.results) >= b.conf.MaxItems || b.size >= b.conf.MaxBytes
+}
+
+// flushDue fires once the oldest queued result has waited for the flush window
+func (b *batcher) flushDue() <-chan time.Time {
+	return b.timer.C
+}
+
+func (b *batcher) take() []common.TaskRes {
+	b.timer.Stop()
+
+	results := b.results
+	b.results = nil
+	b.size = 0
+	return results
+}
+
+func (b *batcher) len() int {
+	return len(b.results)
+}
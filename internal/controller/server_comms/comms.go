@@ -2,11 +2,14 @@ package servercomms
 
 import (
 	"backend/internal/common"
+	"backend/internal/controller/outbox"
 	"backend/internal/controller/terminal"
 	"context"
-	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"sync"
 	"time"
@@ -24,8 +27,18 @@ type ServerConnector struct {
 	dialer        *websocket.Dialer
 	registry      *terminal.TerminalConnector // registry of present accounts
 	taskRequests  chan common.TaskReq
-	taskResponses chan common.TaskRes
-	registered    bool // whether we informed the server or not that we are live
+	taskResponses chan common.TaskRes                  // fed from outgoing in priority order
+	events        chan common.TerminalEvent            // terminal events, best effort
+	outgoing      *common.Lanes[common.TaskRes]        // results waiting for the writer, one lane per priority
+	outbox        *outbox.Outbox                       // responses waiting for a server ack
+	unacked       *common.RetryTracker[common.TaskRes] // responses sent on the current connection
+	registered    bool                                 // whether we informed the server or not that we are live
+	caps          common.Capabilities                  // advertised to the server in the hello
+	features      []common.Feature                     // features the server agreed to on this connection
+	heartbeat     common.HeartbeatConfig
+	reconnect     common.BackoffConfig
+	batching      common.BatchConfig
+	state         *stateMachine
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -34,43 +47,88 @@ type ServerConnector struct {
 }
 
 func NewServerConnector(conf common.ControllerConfig, registry *terminal.TerminalConnector) (*ServerConnector, error) {
+	ob, err := outbox.Open(filepath.Join(conf.DataDir, "outbox.log"))
+	if err != nil {
+		return nil, err
+	}
+
+	if pending := ob.Len(); pending > 0 {
+		log.Printf("[ctrl-ws] %d unacked responses in outbox", pending)
+	}
+
 	return &ServerConnector{
 		serverUrl:    conf.ServerWsUrl,
 		authToken:    conf.Token,
 		controllerId: conf.Id,
 		capacity:     conf.Capacity,
 
-		dialer: &websocket.Dialer{HandshakeTimeout: 5 * time.Second},
+		dialer: &websocket.Dialer{
+			HandshakeTimeout: 5 * time.Second,
+			// per-message deflate is only used if the server agrees to it during the upgrade
+			EnableCompression: conf.Compression,
+		},
 
 		registry:      registry,
 		taskRequests:  make(chan common.TaskReq),
 		taskResponses: make(chan common.TaskRes),
+		events:        make(chan common.TerminalEvent, 256),
+		outgoing:      common.NewLanes(1024, common.ResultPriority),
+		outbox:        ob,
+		unacked:       common.NewRetryTracker[common.TaskRes](conf.AckRetry),
+		heartbeat:     conf.Heartbeat.WithDefaults(),
+		reconnect:     conf.Reconnect.WithDefaults(),
+		batching:      conf.Batching,
+		state:         newStateMachine(),
 	}, nil
 }
 
 func (sc *ServerConnector) Start(parentCtx context.Context) error {
 	sc.ctx, sc.cancel = context.WithCancel(parentCtx)
+	backoff := common.NewBackoff(sc.reconnect)
+
+	go sc.outgoing.Pump(sc.ctx, sc.taskResponses)
 
 	log.Println("[ctrl] starting controller")
 	for {
-		select {
-		case <-sc.ctx.Done():
+		if sc.ctx.Err() != nil {
 			return nil
-		default:
-			if err := sc.connect(); err != nil {
-				log.Printf("[ctrl-ws] connect error: %v, retrying in 5s", err)
-				time.Sleep(5 * time.Second)
-				continue
+		}
+
+		if err := sc.connect(); err != nil {
+			sc.state.set(StateDisconnected)
+			delay := backoff.Next()
+			log.Printf("[ctrl-ws] connect error: %v, retrying in %s", err, delay.Round(time.Millisecond))
+			if !common.Sleep(sc.ctx, delay) {
+				return nil
 			}
+			continue
 		}
 
+		backoff.Reset()
+
 		// blocks until the connection is closed and it exits to try to connect again
 		sc.handleConnection()
-		log.Println("[ctrl-ws] disconnected retrying in 5s...")
-		time.Sleep(5 * time.Second)
+		sc.state.set(StateDisconnected)
+
+		delay := backoff.Next()
+		log.Printf("[ctrl-ws] disconnected retrying in %s...", delay.Round(time.Millisecond))
+		if !common.Sleep(sc.ctx, delay) {
+			return nil
+		}
 	}
 }
 
+// State is the current server link state
+func (sc *ServerConnector) State() ConnState {
+	return sc.state.get()
+}
+
+// Subscribe receives the link state straight away and on every change after that.
+// Slow readers only see the latest state. Call the returned func to stop
+func (sc *ServerConnector) Subscribe() (<-chan ConnState, func()) {
+	return sc.state.subscribe()
+}
+
 func (sc *ServerConnector) connect() error {
 	headers := http.Header{}
 	headers.Add("X-Controller-Id", sc.controllerId)
@@ -79,7 +137,9 @@ func (sc *ServerConnector) connect() error {
 		headers.Add("Authorization", "Bearer "+sc.authToken)
 	}
 
-	conn, resp, err := sc.dialer.Dial(sc.serverUrl, headers)
+	sc.state.set(StateConnecting)
+
+	conn, resp, err := sc.dialer.DialContext(sc.ctx, sc.serverUrl, headers)
 	if err != nil {
 		if resp != nil {
 			log.Printf("[ctrl-ws] handshake failed with status: %d", resp.StatusCode)
@@ -88,27 +148,130 @@ func (sc *ServerConnector) connect() error {
 		return err
 	}
 
+	sc.state.set(StateHandshaking)
+
+	ack, err := sc.hello(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	conn.EnableWriteCompression(slices.Contains(ack.Features, common.FeatureCompression))
+
 	sc.mu.Lock()
 	sc.conn = conn
 	sc.registered = true
+	sc.features = ack.Features
 	sc.mu.Unlock()
 
-	log.Println("[ctrl-ws] connected to ", sc.serverUrl)
+	sc.state.set(StateReady)
+
+	log.Printf("[ctrl-ws] connected to %s (protocol v%d, features %v)", sc.serverUrl, ack.ProtocolVersion, ack.Features)
 	return nil
 }
 
+// hello tells the server what this build supports and waits for it to accept us
+func (sc *ServerConnector) hello(conn *websocket.Conn) (common.HelloAck, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	sc.mu.RLock()
+	hello := common.NewHello(sc.controllerId, sc.capacity, sc.caps)
+	sc.mu.RUnlock()
+
+	if err := sc.writeEnvelope(conn, common.MsgHello, hello); err != nil {
+		return common.HelloAck{}, fmt.Errorf("failed to send hello: %v", err)
+	}
+
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return common.HelloAck{}, fmt.Errorf("failed to read hello ack: %v", err)
+	}
+
+	env, err := common.DecodeEnvelope(data)
+	if err != nil {
+		return common.HelloAck{}, fmt.Errorf("invalid hello reply: %v", err)
+	}
+
+	if env.Kind == common.MsgError {
+		var msg common.ErrorMsg
+		_ = env.Decode(&msg)
+		return common.HelloAck{}, fmt.Errorf("server rejected hello: %s", msg.Message)
+	}
+
+	if env.Kind != common.MsgHelloAck {
+		return common.HelloAck{}, fmt.Errorf("unexpected hello reply: %s", env.Kind)
+	}
+
+	var ack common.HelloAck
+	if err := env.Decode(&ack); err != nil {
+		return common.HelloAck{}, err
+	}
+
+	if !ack.Accepted {
+		return common.HelloAck{}, fmt.Errorf("server refused controller: %s", ack.Reason)
+	}
+
+	if ack.ProtocolVersion < common.MinProtocolVersion || ack.ProtocolVersion > common.ProtocolVersion {
+		return common.HelloAck{}, fmt.Errorf("server picked unsupported protocol version %d", ack.ProtocolVersion)
+	}
+
+	return ack, nil
+}
+
+// SetCapabilities sets what is advertised to the server on the next connect
+func (sc *ServerConnector) SetCapabilities(caps common.Capabilities) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.caps = caps
+}
+
+func (sc *ServerConnector) HasFeature(feature common.Feature) bool {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return slices.Contains(sc.features, feature)
+}
+
 func (sc *ServerConnector) handleConnection() {
 	var wg sync.WaitGroup
 	wg.Add(2)
 
+	conn := func() *websocket.Conn {
+		sc.mu.RLock()
+		defer sc.mu.RUnlock()
+		return sc.conn
+	}()
+
+	// a server that stops answering pings (half-open tcp) fails the read and we reconnect
+	readTimeout := sc.heartbeat.ReadTimeout()
+	_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(readTimeout))
+	})
+
+	// closed by the reader so the writer does not outlive the connection
+	done := make(chan struct{})
+	// acks and errors are written by the writer since the websocket only allows a single writer
+	frames := make(chan []byte, 64)
+
+	queueFrame := func(kind common.MessageKind, payload any) bool {
+		data, err := common.EncodeEnvelope(kind, payload)
+		if err != nil {
+			log.Printf("[ctrl-ws] %v", err)
+			return true
+		}
+
+		select {
+		case frames <- data:
+			return true
+		case <-sc.ctx.Done():
+			return false
+		}
+	}
+
 	go func() {
 		defer wg.Done()
-
-		conn := func() *websocket.Conn {
-			sc.mu.RLock()
-			defer sc.mu.RUnlock()
-			return sc.conn
-		}()
+		defer close(done)
 
 		for {
 			_, data, err := conn.ReadMessage()
@@ -118,24 +281,74 @@ func (sc *ServerConnector) handleConnection() {
 				return
 			}
 
-			var task common.TaskReq
-			if err := json.Unmarshal(data, &task); err != nil {
-				log.Printf("[ctrl-ws] invalid task: %v", err)
+			_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
+
+			env, err := common.DecodeEnvelope(data)
+			if err != nil {
+				log.Printf("[ctrl-ws] rejected message: %v", err)
+				if !queueFrame(common.MsgError, common.ErrorMsg{Message: err.Error()}) {
+					return
+				}
 				continue
 			}
 
-			/**
-							send to the respective channel so for instance have terminal requests
-			controller requests, etc. So each can have a goroutine listening to it's type of messages. For terminal related ones, they can be directly sent to the right terminal instead of routing it separately or having that entire goroutine
-						**/
-			select {
-			case sc.taskRequests <- task:
-				go sc.sendAck(task.Id)
-			case <-sc.ctx.Done():
-				return
-			}
+			switch env.Kind {
+			case common.MsgTask:
+				var task common.TaskReq
+				if err := env.Decode(&task); err != nil {
+					log.Printf("[ctrl-ws] invalid task: %v", err)
+					if !queueFrame(common.MsgError, common.ErrorMsg{Message: err.Error()}) {
+						return
+					}
+					continue
+				}
+
+				/**
+								send to the respective channel so for instance have terminal requests
+				controller requests, etc. So each can have a goroutine listening to it's type of messages. For terminal related ones, they can be directly sent to the right terminal instead of routing it separately or having that entire goroutine
+							**/
+				select {
+				case sc.taskRequests <- task:
+				case <-sc.ctx.Done():
+					return
+				}
 
-			// send server ack
+				// tell the server we own the request now so it stops retrying it
+				if !queueFrame(common.MsgAck, common.NewTaskAck(common.AckRequest, task.Id)) {
+					return
+				}
+
+			case common.MsgAck:
+				var ack common.TaskAck
+				if err := env.Decode(&ack); err != nil {
+					log.Printf("[ctrl-ws] invalid ack: %v", err)
+					continue
+				}
+
+				// server acked one of our responses so it no longer needs to be resent or replayed.
+				// Handled here, the task handler may be busy and acks must not wait behind tasks
+				if ack.Kind == common.AckResponse {
+					sc.unacked.Ack(ack.ReqId)
+					if err := sc.outbox.Ack(ack.ReqId, ack.Seq); err != nil {
+						log.Printf("[ctrl-ws] failed to ack response %d in outbox: %v", ack.ReqId, err)
+					}
+
+					// the EA's copy of the result can go too
+					sc.registry.AckResponse(ack.ReqId)
+				}
+
+			case common.MsgHeartbeat:
+				// nothing to do yet, any frame proves the link is alive
+
+			case common.MsgError:
+				var msg common.ErrorMsg
+				if err := env.Decode(&msg); err == nil {
+					log.Printf("[ctrl-ws] server reported error (request %d): %s", msg.ReqId, msg.Message)
+				}
+
+			default:
+				log.Printf("[ctrl-ws] unexpected %s message from server", env.Kind)
+			}
 		}
 	}()
 
@@ -143,27 +356,128 @@ func (sc *ServerConnector) handleConnection() {
 	go func() {
 		defer wg.Done()
 
+		// let the server know which terminals live here before anything else
+		if err := sc.writeEnvelope(conn, common.MsgInventory, sc.registry.Inventory()); err != nil {
+			log.Printf("[ctrl-ws] inventory write error: %v", err)
+			sc.closeConn()
+			return
+		}
+
+		// anything the server has not acked yet goes out first and in order. The same results
+		// may still be queued in the lanes, those are skipped when the writer gets to them
+		sc.unacked.Clear()
+		replayed := make(map[uint64]struct{})
+		for _, taskRes := range sc.outbox.Pending() {
+			replayed[taskRes.Seq] = struct{}{}
+			if err := sc.writeResponse(conn, taskRes); err != nil {
+				log.Printf("[ctrl-ws] replay write error: %v", err)
+				sc.closeConn()
+				return
+			}
+		}
+
+		retryTicker := time.NewTicker(retryInterval(sc.unacked.Policy()))
+		defer retryTicker.Stop()
+
+		pingTicker := time.NewTicker(sc.heartbeat.PingInterval)
+		defer pingTicker.Stop()
+
+		// anything still batched when the connection drops is in the outbox and gets replayed
+		batching := sc.batching.Enabled() && sc.HasFeature(common.FeatureBatching)
+		batch := newBatcher(sc.batching)
+		defer batch.take()
+
 		for {
 			select {
 			case <-sc.ctx.Done():
 				return
-			case taskRes := <-sc.taskResponses:
-				data, _ := json.Marshal(taskRes)
-				sc.mu.RLock()
-				c := sc.conn
-				sc.mu.RUnlock()
-
-				if c == nil {
-					log.Printf("[ctrl-ws] write failed no active connection")
-					sc.queueFailedResponse(taskRes)
+			case <-done:
+				return
+			case <-pingTicker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(sc.heartbeat.PongTimeout)); err != nil {
+					log.Printf("[ctrl-ws] ping error: %v", err)
+					sc.closeConn()
 					return
 				}
+			case frame := <-frames:
+				if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+					log.Printf("[ctrl-ws] write error: %v", err)
+					sc.closeConn()
+					return
+				}
+			case now := <-retryTicker.C:
+				// older servers never ack responses, the outbox replay on reconnect still covers them
+				if !sc.HasFeature(common.FeatureAckRetry) {
+					continue
+				}
+
+				retry, expired := sc.unacked.Due(now)
+				for _, taskRes := range expired {
+					// stored results keep going out on this connection, tracking them again starts a new round
+					if taskRes.Seq == 0 || !sc.outbox.Has(taskRes.Seq) {
+						log.Printf("[ctrl-ws] response %d not acked after %d attempts, dropping it", taskRes.ReqId, sc.unacked.Policy().MaxAttempts)
+						continue
+					}
+
+					log.Printf("[ctrl-ws] response %d not acked after %d attempts, resending it from the outbox", taskRes.ReqId, sc.unacked.Policy().MaxAttempts)
+					if err := sc.writeResponse(conn, taskRes); err != nil {
+						log.Printf("[ctrl-ws] retry write error: %v", err)
+						sc.closeConn()
+						return
+					}
+				}
+
+				for _, taskRes := range retry {
+					if err := sc.writeEnvelope(conn, common.MsgResult, taskRes); err != nil {
+						log.Printf("[ctrl-ws] retry write error: %v", err)
+						sc.closeConn()
+						return
+					}
+				}
+			case taskRes := <-sc.taskResponses:
+				// the task handler stored it already, skip it when it was replayed or acked meanwhile
+				if taskRes.Seq != 0 {
+					if _, ok := replayed[taskRes.Seq]; ok || !sc.outbox.Has(taskRes.Seq) {
+						continue
+					}
+				}
 
-				if err := c.WriteMessage(websocket.TextMessage, data); err != nil {
+				if batching && batchable(taskRes) {
+					if batch.add(taskRes) {
+						if err := sc.writeBatch(conn, batch.take()); err != nil {
+							log.Printf("[ctrl-ws] batch write error: %v", err)
+							sc.closeConn()
+							return
+						}
+					}
+					continue
+				}
+
+				if err := sc.writeResponse(conn, taskRes); err != nil {
 					log.Printf("[ctrl-ws] write error: %v", err)
 					sc.closeConn()
 					return
 				}
+			case event := <-sc.events:
+				if !sc.HasFeature(common.FeatureEvents) {
+					continue
+				}
+
+				if err := sc.writeEnvelope(conn, common.MsgEvent, event); err != nil {
+					log.Printf("[ctrl-ws] event write error: %v", err)
+					sc.closeConn()
+					return
+				}
+			case <-batch.flushDue():
+				if batch.len() == 0 {
+					continue
+				}
+
+				if err := sc.writeBatch(conn, batch.take()); err != nil {
+					log.Printf("[ctrl-ws] batch write error: %v", err)
+					sc.closeConn()
+					return
+				}
 			}
 		}
 	}()
@@ -171,19 +485,72 @@ func (sc *ServerConnector) handleConnection() {
 	wg.Wait()
 }
 
-func (sc *ServerConnector) sendAck(taskID int) {
-	// we never ack the server messages, rather, we resend responses from the terminals if they are not acked
-	sc.mu.RLock()
-	defer sc.mu.RUnlock()
-	if sc.conn == nil {
-		return
+// writeResponse sends a response and starts waiting for the server to ack it
+func (sc *ServerConnector) writeResponse(conn *websocket.Conn, taskRes common.TaskRes) error {
+	if err := sc.writeEnvelope(conn, common.MsgResult, taskRes); err != nil {
+		return err
+	}
+
+	sc.unacked.Track(taskRes.ReqId, taskRes)
+	return nil
+}
+
+// writeBatch sends many data results in one frame, the server still acks each of them
+func (sc *ServerConnector) writeBatch(conn *websocket.Conn, results []common.TaskRes) error {
+	if err := sc.writeEnvelope(conn, common.MsgBatch, common.ResultBatch{Results: results}); err != nil {
+		return err
 	}
 
-	ack := map[string]any{"type": "ack", "taskId": taskID}
-	data, _ := json.Marshal(ack)
-	if err := sc.conn.WriteMessage(websocket.TextMessage, data); err != nil {
-		log.Printf("[ctrl-ws] ack write error: %v", err)
+	for _, taskRes := range results {
+		sc.unacked.Track(taskRes.ReqId, taskRes)
 	}
+
+	return nil
+}
+
+func (sc *ServerConnector) writeEnvelope(conn *websocket.Conn, kind common.MessageKind, payload any) error {
+	data, err := common.EncodeEnvelope(kind, payload)
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// check for due retries a few times per timeout window
+func retryInterval(policy common.RetryPolicy) time.Duration {
+	interval := policy.Timeout / 4
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+
+	return interval
+}
+
+// SendEvent queues a terminal event for the server. Events are informational, when the link
+// has been down long enough to fill the queue they are dropped
+func (sc *ServerConnector) SendEvent(event common.TerminalEvent) {
+	select {
+	case sc.events <- event:
+	default:
+		log.Printf("[ctrl-ws] event queue full, dropping %s event of terminal %s", event.Kind, event.TerminalId)
+	}
+}
+
+// Requests are the tasks received from the server, consumed by the task handler
+func (sc *ServerConnector) Requests() <-chan common.TaskReq {
+	return sc.taskRequests
+}
+
+// Responses accepts task results that need to be delivered to the server, trade results
+// from master accounts are written first
+func (sc *ServerConnector) Responses() *common.Lanes[common.TaskRes] {
+	return sc.outgoing
+}
+
+// Outbox keeps results until the server acks them, producers append before pushing to Responses
+func (sc *ServerConnector) Outbox() *outbox.Outbox {
+	return sc.outbox
 }
 
 func (sc *ServerConnector) closeConn() {
@@ -191,6 +558,7 @@ func (sc *ServerConnector) closeConn() {
 	defer sc.mu.Unlock()
 
 	if sc.conn != nil {
+		sc.state.set(StateDraining)
 		sc.conn.Close()
 		sc.conn = nil
 	}
@@ -198,18 +566,11 @@ func (sc *ServerConnector) closeConn() {
 	sc.registered = false
 }
 
-func (sc *ServerConnector) queueFailedResponse(res common.TaskRes) {
-	// maybe store this in redis or a db somewhere
-	// on reconnect, we slowly pass them on to the main server or queue them
-	select {
-	case sc.taskResponses <- res:
-		// queued again for resend
-	default:
-		log.Println("[ctrl-ws] dropping response, queue full")
-	}
-}
-
 func (sc *ServerConnector) Stop() {
 	sc.cancel()
 	sc.closeConn()
+
+	if err := sc.outbox.Close(); err != nil {
+		log.Printf("[ctrl-ws] failed to close outbox: %v", err)
+	}
 }
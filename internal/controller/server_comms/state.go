@@ -0,0 +1,114 @@
+package servercomms
+
+import (
+	"log"
+	"sync"
+)
+
+// ConnState is where the server link is at, other controller parts subscribe to it
+type ConnState int
+
+const (
+	StateDisconnected ConnState = iota
+	StateConnecting             // dialing the server
+	StateHandshaking            // websocket is up, waiting for the hello ack
+	StateReady                  // tasks and results are flowing
+	StateDraining               // connection is being torn down
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateHandshaking:
+		return "handshaking"
+	case StateReady:
+		return "ready"
+	case StateDraining:
+		return "draining"
+	default:
+		return "unknown"
+	}
+}
+
+var validTransitions = map[ConnState][]ConnState{
+	StateDisconnected: {StateConnecting, StateDraining},
+	StateConnecting:   {StateHandshaking, StateDisconnected, StateDraining},
+	StateHandshaking:  {StateReady, StateDisconnected, StateDraining},
+	StateReady:        {StateDraining, StateDisconnected},
+	StateDraining:     {StateDisconnected},
+}
+
+type stateMachine struct {
+	mu    sync.Mutex
+	state ConnState
+	subs  map[chan ConnState]struct{}
+}
+
+func newStateMachine() *stateMachine {
+	return &stateMachine{
+		state: StateDisconnected,
+		subs:  make(map[chan ConnState]struct{}),
+	}
+}
+
+func (sm *stateMachine) get() ConnState {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.state
+}
+
+// set moves to the next state, invalid transitions are logged and ignored
+func (sm *stateMachine) set(next ConnState) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sm.state == next {
+		return true
+	}
+
+	allowed := false
+	for _, state := range validTransitions[sm.state] {
+		if state == next {
+			allowed = true
+			break
+		}
+	}
+
+	if !allowed {
+		log.Printf("[ctrl-ws] ignoring invalid state change %s -> %s", sm.state, next)
+		return false
+	}
+
+	sm.state = next
+
+	for sub := range sm.subs {
+		// subscribers only care about the latest state, replace whatever they haven't read
+		select {
+		case <-sub:
+		default:
+		}
+		sub <- next
+	}
+
+	return true
+}
+
+func (sm *stateMachine) subscribe() (<-chan ConnState, func()) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sub := make(chan ConnState, 1)
+	sub <- sm.state
+	sm.subs[sub] = struct{}{}
+
+	unsubscribe := func() {
+		sm.mu.Lock()
+		defer sm.mu.Unlock()
+		delete(sm.subs, sub)
+	}
+
+	return sub, unsubscribe
+}
@@ -0,0 +1,73 @@
+package terminal
+
+import (
+	"backend/internal/common"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// indexAccountLocked points the account at the terminal (caller holds tc.mu)
+func (tc *TerminalConnector) indexAccountLocked(terminalId string, login int, server string) {
+	if login == 0 {
+		return
+	}
+
+	key := common.AccountKey(login, server)
+	if !slices.Contains(tc.accounts[key], terminalId) {
+		tc.accounts[key] = append(tc.accounts[key], terminalId)
+	}
+}
+
+func (tc *TerminalConnector) unindexAccountLocked(terminalId string, login int, server string) {
+	key := common.AccountKey(login, server)
+
+	ids := slices.DeleteFunc(tc.accounts[key], func(id string) bool { return id == terminalId })
+	if len(ids) == 0 {
+		delete(tc.accounts, key)
+		return
+	}
+
+	tc.accounts[key] = ids
+}
+
+// TerminalsForAccount returns the ids of the terminals logged into the account
+func (tc *TerminalConnector) TerminalsForAccount(login int, server string) []string {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	return slices.Clone(tc.accounts[common.AccountKey(login, server)])
+}
+
+// Resolve finds the terminal a request is meant for, by terminal id or else by login and server
+func (tc *TerminalConnector) Resolve(misc *common.TerminalMiscData) (*Terminal, error) {
+	if misc == nil {
+		return nil, fmt.Errorf("[ctrl] invalid request - missing terminal id or account")
+	}
+
+	if misc.TerminalId != "" {
+		terminal, ok := tc.Get(misc.TerminalId)
+		if !ok {
+			return nil, fmt.Errorf("[ctrl] terminal %s not found", misc.TerminalId)
+		}
+
+		return terminal, nil
+	}
+
+	if misc.AccountId == 0 {
+		return nil, fmt.Errorf("[ctrl] invalid request - missing terminal id or account")
+	}
+
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+
+	ids := tc.accounts[common.AccountKey(misc.AccountId, misc.Server)]
+	switch len(ids) {
+	case 0:
+		return nil, fmt.Errorf("[ctrl] no terminal for account %d on %s", misc.AccountId, misc.Server)
+	case 1:
+		return tc.terminals[ids[0]], nil
+	default:
+		return nil, fmt.Errorf("[ctrl] account %d on %s is ambiguous, hosted by terminals %s - name the terminal id",
+			misc.AccountId, misc.Server, strings.Join(ids, ", "))
+	}
+}
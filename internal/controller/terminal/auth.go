@@ -0,0 +1,131 @@
+package terminal
+
+import (
+	"backend/internal/common"
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// name of the EA inputs file, matches ExpertParameters in the mt4/mt5 configs
+const eaParamsFile = "TraderkitCore.set"
+
+// handshake messages after the terminal announced itself
+type authChallenge struct {
+	Type  string `json:"type"` // "challenge"
+	Nonce string `json:"nonce"`
+}
+
+type authResponse struct {
+	Type    string   `json:"type"` // "auth"
+	Hmac    string   `json:"hmac"`
+	Framing []string `json:"framing,omitempty"` // framing modes the EA can switch to, older EAs send none
+}
+
+type authResult struct {
+	Type    string `json:"type"`    // "auth_ok"
+	Framing string `json:"framing"` // used by both sides from the next message on
+}
+
+func generateSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("[ctrl] failed to generate terminal secret: %v", err)
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+func generateNonce() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// authMac is what the EA has to send back: hex(HMAC-SHA256(secret, nonce + terminal id))
+func authMac(secret string, nonce string, terminalId string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(nonce + terminalId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func verifyAuth(secret string, nonce string, terminalId string, got string) bool {
+	if secret == "" {
+		return false
+	}
+
+	expected := authMac(secret, nonce, terminalId)
+	return hmac.Equal([]byte(expected), []byte(strings.ToLower(got)))
+}
+
+func presetsDir(terminalDir string, termType common.TerminalType) string {
+	if termType == common.MT4 {
+		return filepath.Join(terminalDir, "MQL4", "Presets")
+	}
+
+	return filepath.Join(terminalDir, "MQL5", "Presets")
+}
+
+// writeEAParams writes the EA inputs, including the per-terminal secret used in the handshake
+func writeEAParams(terminalDir string, details TerminalDeploy, controllerAddr string, secret string) error {
+	dir := presetsDir(terminalDir, details.Type)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("[ctrl] failed to create presets dir: %v", err)
+	}
+
+	params := strings.Join([]string{
+		"TerminalId=" + details.Id,
+		"ControllerAddress=" + controllerAddr,
+		"TerminalSecret=" + secret,
+		"CopyMaster=" + strconv.FormatBool(details.Master),
+	}, "\n") + "\n"
+
+	// only the terminal (and us) should be able to read the secret
+	if err := os.WriteFile(filepath.Join(dir, eaParamsFile), []byte(params), 0600); err != nil {
+		return fmt.Errorf("[ctrl] failed to write ea params: %v", err)
+	}
+
+	return nil
+}
+
+// readSecret loads the secret back from the EA inputs, used when a terminal is reloaded after a restart
+func readSecret(terminalDir string, termType common.TerminalType) (string, error) {
+	secret, err := readEAParam(terminalDir, termType, "TerminalSecret")
+	if err != nil {
+		return "", err
+	}
+	if secret == "" {
+		return "", fmt.Errorf("[ctrl] no terminal secret in ea params")
+	}
+
+	return secret, nil
+}
+
+// readEAParam returns one EA input as written by writeEAParams, empty when it isn't set
+func readEAParam(terminalDir string, termType common.TerminalType, key string) (string, error) {
+	file, err := os.Open(filepath.Join(presetsDir(terminalDir, termType), eaParamsFile))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if ok && name == key {
+			return value, nil
+		}
+	}
+
+	return "", scanner.Err()
+}
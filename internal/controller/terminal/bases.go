@@ -0,0 +1,642 @@
+package terminal
+
+import (
+	"archive/zip"
+	"backend/internal/common"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// base installs live in <bases dir>/<mt4|mt5>/<version>/ with a manifest of every file's sha256,
+// the current file names the version new terminals are cloned from
+const (
+	baseManifestFile = "manifest.json"
+	baseCurrentFile  = "current"
+	baseMarkerFile   = ".base"        // in terminal dirs, the version the terminal was cloned from
+	baseBackupDir    = ".base-backup" // in terminal dirs, what a rollout replaced until it's done
+	maxBaseDownload  = 2 << 30
+	baseFetchTimeout = 30 * time.Minute
+)
+
+var baseVersionPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// written per deployment, never cloned from a base or replaced by one
+var terminalOwnedPaths = []string{
+	"config.ini", "logs", "controller.sock", baseMarkerFile, baseBackupDir,
+	"MQL4/Files", "MQL5/Files", "MQL4/Presets", "MQL5/Presets",
+}
+
+// binaries are shared through hardlinks, the rest is copied so a terminal writing to it can't change the base
+var linkedExtensions = map[string]bool{".exe": true, ".dll": true, ".ex4": true, ".ex5": true}
+
+type baseManifest struct {
+	Type    common.TerminalType `json:"type"`
+	Version string              `json:"version"`
+	Files   map[string]string   `json:"files"` // slash separated path -> sha256
+}
+
+// BaseUpdateResult answers ctrl_update_mt4/ctrl_update_mt5
+type BaseUpdateResult struct {
+	Type     common.TerminalType `json:"type"`
+	Version  string              `json:"version"`
+	Previous string              `json:"previous,omitempty"`
+	Updated  []string            `json:"updated"`
+	Skipped  []string            `json:"skipped,omitempty"` // not stopped, left on their current files
+}
+
+type baseStore struct {
+	mu  sync.RWMutex // clones read, switching versions writes
+	dir string
+}
+
+func newBaseStore(dir string) *baseStore {
+	return &baseStore{dir: dir}
+}
+
+func (b *baseStore) versionDir(termType common.TerminalType, version string) string {
+	return filepath.Join(b.dir, string(termType), version)
+}
+
+// current returns the version new terminals get, empty when none was installed
+func (b *baseStore) current(termType common.TerminalType) (string, error) {
+	raw, err := os.ReadFile(filepath.Join(b.dir, string(termType), baseCurrentFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+
+	return strings.TrimSpace(string(raw)), err
+}
+
+func (b *baseStore) setCurrent(termType common.TerminalType, version string) error {
+	path := filepath.Join(b.dir, string(termType), baseCurrentFile)
+	tmp := path + ".tmp"
+
+	if err := os.WriteFile(tmp, []byte(version+"\n"), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (b *baseStore) manifest(termType common.TerminalType, version string) (*baseManifest, error) {
+	raw, err := os.ReadFile(filepath.Join(b.versionDir(termType, version), baseManifestFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest baseManifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, fmt.Errorf("bad manifest of %s base %s: %v", termType, version, err)
+	}
+
+	return &manifest, nil
+}
+
+// clone puts the current base into a new terminal dir, terminals without a base keep whatever is there
+func (b *baseStore) clone(termType common.TerminalType, dir string) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	version, err := b.current(termType)
+	if err != nil {
+		return err
+	}
+
+	if version == "" {
+		log.Printf("[ctrl] no %s base installed, %s keeps its own files", termType, dir)
+		return nil
+	}
+
+	manifest, err := b.manifest(termType, version)
+	if err != nil {
+		return err
+	}
+
+	src := b.versionDir(termType, version)
+	for rel := range manifest.Files {
+		if terminalOwned(rel) {
+			continue
+		}
+
+		if err := installFile(filepath.Join(src, filepath.FromSlash(rel)), filepath.Join(dir, filepath.FromSlash(rel))); err != nil {
+			return fmt.Errorf("failed to clone %s: %v", rel, err)
+		}
+	}
+
+	return os.WriteFile(filepath.Join(dir, baseMarkerFile), []byte(version+"\n"), 0644)
+}
+
+func terminalOwned(rel string) bool {
+	for _, owned := range terminalOwnedPaths {
+		if strings.EqualFold(rel, owned) || strings.HasPrefix(strings.ToLower(rel), strings.ToLower(owned)+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// installFile hardlinks or copies src to dst, an existing dst is unlinked first so writes never go through to the base
+func installFile(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	if err := os.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if linkedExtensions[strings.ToLower(filepath.Ext(dst))] {
+		// different filesystems can't link, copying still works
+		if err := os.Link(src, dst); err == nil {
+			return nil
+		}
+	}
+
+	return copyFile(src, dst)
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+func fileSha256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// stage downloads and unpacks a base archive next to the installed versions. The archive has to match
+// the sha256 from the task, and every file the manifest shipped in the archive lists has to match too
+func (b *baseStore) stage(termType common.TerminalType, update common.BaseUpdatePayload) (*baseManifest, error) {
+	if !baseVersionPattern.MatchString(update.Version) {
+		return nil, fmt.Errorf("invalid base version %q", update.Version)
+	}
+
+	// a retried task finds the version already staged, and rolling back to an older one needs no download
+	if manifest, err := b.manifest(termType, update.Version); err == nil {
+		return manifest, nil
+	}
+
+	if update.Url == "" || update.Sha256 == "" {
+		return nil, fmt.Errorf("base update needs a url and a sha256")
+	}
+
+	staging := filepath.Join(b.dir, string(termType), ".staging-"+update.Version)
+	if err := os.RemoveAll(staging); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	archive := filepath.Join(staging, "base.zip")
+	sum, err := fetchBase(update.Url, archive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download base: %v", err)
+	}
+
+	if !strings.EqualFold(sum, update.Sha256) {
+		return nil, fmt.Errorf("base archive checksum mismatch: got %s, want %s", sum, update.Sha256)
+	}
+
+	files := filepath.Join(staging, "files")
+	if err := unzipBase(archive, files); err != nil {
+		return nil, fmt.Errorf("failed to unpack base: %v", err)
+	}
+
+	manifest, err := buildManifest(files, termType, update.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(files, baseManifestFile), raw, 0644); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(files, b.versionDir(termType, update.Version)); err != nil {
+		return nil, err
+	}
+
+	log.Printf("[ctrl] staged %s base %s (%d files)", termType, update.Version, len(manifest.Files))
+	return manifest, nil
+}
+
+// fetchBase saves the archive from an http(s) url or a local path and returns its sha256
+func fetchBase(url string, dst string) (string, error) {
+	var body io.ReadCloser
+
+	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		client := http.Client{Timeout: baseFetchTimeout}
+		res, err := client.Get(url)
+		if err != nil {
+			return "", err
+		}
+
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return "", fmt.Errorf("%s returned %s", url, res.Status)
+		}
+
+		body = res.Body
+	} else {
+		file, err := os.Open(strings.TrimPrefix(url, "file://"))
+		if err != nil {
+			return "", err
+		}
+
+		body = file
+	}
+	defer body.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(out, hash), io.LimitReader(body, maxBaseDownload+1))
+	if err != nil {
+		return "", err
+	}
+
+	if written > maxBaseDownload {
+		return "", fmt.Errorf("archive over %d bytes", int64(maxBaseDownload))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func unzipBase(archive string, dir string) error {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for _, entry := range reader.File {
+		// entries can't point outside the staging dir
+		rel := filepath.Clean(filepath.FromSlash(entry.Name))
+		if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("bad path in archive: %s", entry.Name)
+		}
+
+		dst := filepath.Join(dir, rel)
+		if entry.FileInfo().IsDir() {
+			if err := os.MkdirAll(dst, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := unzipFile(entry, dst); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func unzipFile(entry *zip.File, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	in, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, entry.Mode().Perm()|0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// buildManifest hashes every file of the unpacked base and checks them against the manifest it shipped with
+func buildManifest(dir string, termType common.TerminalType, version string) (*baseManifest, error) {
+	var shipped *baseManifest
+	if raw, err := os.ReadFile(filepath.Join(dir, baseManifestFile)); err == nil {
+		shipped = &baseManifest{}
+		if err := json.Unmarshal(raw, shipped); err != nil {
+			return nil, fmt.Errorf("bad manifest in base archive: %v", err)
+		}
+	}
+
+	manifest := &baseManifest{Type: termType, Version: version, Files: make(map[string]string)}
+
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		rel = filepath.ToSlash(rel)
+		if rel == baseManifestFile {
+			return nil
+		}
+
+		sum, err := fileSha256(path)
+		if err != nil {
+			return err
+		}
+
+		manifest.Files[rel] = sum
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if shipped != nil {
+		for rel, want := range shipped.Files {
+			got, ok := manifest.Files[rel]
+			if !ok {
+				return nil, fmt.Errorf("base archive is missing %s", rel)
+			}
+			if !strings.EqualFold(got, want) {
+				return nil, fmt.Errorf("checksum mismatch for %s: got %s, want %s", rel, got, want)
+			}
+		}
+	}
+
+	return manifest, nil
+}
+
+// UpdateBase stages a new base for termType, rolls it out to the stopped terminals of that type and
+// makes it the base of new deployments. A failed rollout puts every terminal back on its old files
+func (tc *TerminalConnector) UpdateBase(termType common.TerminalType, update common.BaseUpdatePayload) (*BaseUpdateResult, error) {
+	if termType != common.MT4 && termType != common.MT5 {
+		return nil, fmt.Errorf("[ctrl] unknown terminal type %s", termType)
+	}
+
+	// the download can take a while, deployments carry on from the old base meanwhile
+	manifest, err := tc.bases.stage(termType, update)
+	if err != nil {
+		return nil, fmt.Errorf("[ctrl] failed to stage %s base %s: %v", termType, update.Version, err)
+	}
+
+	tc.bases.mu.Lock()
+	defer tc.bases.mu.Unlock()
+
+	previous, err := tc.bases.current(termType)
+	if err != nil {
+		return nil, err
+	}
+
+	// files of the old base that the new one dropped are removed from the terminals
+	var old *baseManifest
+	if previous != "" {
+		if old, err = tc.bases.manifest(termType, previous); err != nil {
+			log.Printf("[ctrl] no manifest for %s base %s, files it dropped stay in place: %v", termType, previous, err)
+		}
+	}
+
+	result := &BaseUpdateResult{Type: termType, Version: update.Version, Previous: previous, Updated: []string{}}
+	src := tc.bases.versionDir(termType, update.Version)
+
+	var updated []string // terminal dirs with a backup to restore or drop
+	for _, term := range tc.terminalsOfType(termType) {
+		// no starts or stops while its files change, held until the rollout is over
+		term.opMu.Lock()
+
+		term.mu.RLock()
+		state, dir := term.state, term.terminalPath
+		term.mu.RUnlock()
+
+		if state != StateStopped || dir == "" {
+			term.opMu.Unlock()
+			result.Skipped = append(result.Skipped, term.Id)
+			continue
+		}
+		defer term.opMu.Unlock()
+
+		updated = append(updated, dir)
+		if err := rolloutBase(dir, old, manifest, src); err != nil {
+			for _, dir := range updated {
+				if err := rollbackBase(dir); err != nil {
+					log.Printf("[ctrl] failed to roll back %s: %v", dir, err)
+				}
+			}
+
+			return nil, fmt.Errorf("[ctrl] %s base %s rollout failed on terminal %s, rolled back: %v", termType, update.Version, term.Id, err)
+		}
+
+		result.Updated = append(result.Updated, term.Id)
+	}
+
+	if err := tc.bases.setCurrent(termType, update.Version); err != nil {
+		for _, dir := range updated {
+			if err := rollbackBase(dir); err != nil {
+				log.Printf("[ctrl] failed to roll back %s: %v", dir, err)
+			}
+		}
+		return nil, err
+	}
+
+	for _, dir := range updated {
+		os.RemoveAll(filepath.Join(dir, baseBackupDir))
+	}
+
+	log.Printf("[ctrl] %s base now %s, updated %d terminals, skipped %d", termType, update.Version, len(result.Updated), len(result.Skipped))
+	return result, nil
+}
+
+func (tc *TerminalConnector) terminalsOfType(termType common.TerminalType) []*Terminal {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+
+	terminals := make([]*Terminal, 0, len(tc.terminals))
+	for _, term := range tc.terminals {
+		if term.Type == termType {
+			terminals = append(terminals, term)
+		}
+	}
+
+	slices.SortFunc(terminals, func(a, b *Terminal) int {
+		return strings.Compare(a.Id, b.Id)
+	})
+
+	return terminals
+}
+
+// rolloutBase replaces the files that differ from the manifest and removes the ones only the old manifest
+// had, keeping what it replaced or removed in the backup dir.
+// The list of files it added is always written so a partial rollout can be rolled back too
+func rolloutBase(dir string, old, manifest *baseManifest, src string) (err error) {
+	backup := filepath.Join(dir, baseBackupDir)
+	if err := os.RemoveAll(backup); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(backup, "files"), 0755); err != nil {
+		return err
+	}
+
+	if err := copyFile(filepath.Join(dir, baseMarkerFile), filepath.Join(backup, baseMarkerFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	added := []string{}
+	defer func() {
+		raw, _ := json.Marshal(added)
+		if writeErr := os.WriteFile(filepath.Join(backup, "added.json"), raw, 0644); writeErr != nil && err == nil {
+			err = writeErr
+		}
+	}()
+
+	for _, rel := range slices.Sorted(maps.Keys(manifest.Files)) {
+		if terminalOwned(rel) {
+			continue
+		}
+
+		dst := filepath.Join(dir, filepath.FromSlash(rel))
+		sum, err := fileSha256(dst)
+
+		switch {
+		case err == nil && sum == manifest.Files[rel]:
+			continue
+		case err == nil:
+			saved := filepath.Join(backup, "files", filepath.FromSlash(rel))
+			if err := os.MkdirAll(filepath.Dir(saved), 0755); err != nil {
+				return err
+			}
+			if err := os.Rename(dst, saved); err != nil {
+				return err
+			}
+		case errors.Is(err, os.ErrNotExist):
+			added = append(added, rel)
+		default:
+			return err
+		}
+
+		if err := installFile(filepath.Join(src, filepath.FromSlash(rel)), dst); err != nil {
+			return err
+		}
+	}
+
+	if old != nil {
+		for _, rel := range slices.Sorted(maps.Keys(old.Files)) {
+			if _, kept := manifest.Files[rel]; kept || terminalOwned(rel) {
+				continue
+			}
+
+			saved := filepath.Join(backup, "files", filepath.FromSlash(rel))
+			if err := os.MkdirAll(filepath.Dir(saved), 0755); err != nil {
+				return err
+			}
+			if err := os.Rename(filepath.Join(dir, filepath.FromSlash(rel)), saved); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+
+	return os.WriteFile(filepath.Join(dir, baseMarkerFile), []byte(manifest.Version+"\n"), 0644)
+}
+
+// rollbackBase undoes rolloutBase from the backup dir
+func rollbackBase(dir string) error {
+	backup := filepath.Join(dir, baseBackupDir)
+
+	var added []string
+	if raw, err := os.ReadFile(filepath.Join(backup, "added.json")); err == nil {
+		json.Unmarshal(raw, &added)
+	}
+
+	for _, rel := range added {
+		if err := os.Remove(filepath.Join(dir, filepath.FromSlash(rel))); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	saved := filepath.Join(backup, "files")
+	err := filepath.WalkDir(saved, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(saved, path)
+		if err != nil {
+			return err
+		}
+
+		dst := filepath.Join(dir, rel)
+		if err := os.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		return os.Rename(path, dst)
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	marker := filepath.Join(dir, baseMarkerFile)
+	if err := os.Rename(filepath.Join(backup, baseMarkerFile), marker); errors.Is(err, os.ErrNotExist) {
+		os.Remove(marker)
+	}
+
+	return os.RemoveAll(backup)
+}
@@ -2,147 +2,348 @@ package terminal
 
 import (
 	"backend/internal/common"
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"sync"
 	"time"
 )
 
-type accountType struct {
-	Login  int
-	Server string
-}
-
 type TerminalConnector struct {
 	mu                sync.RWMutex
 	terminalRawTcpUrl string
-	accounts          map[string]accountType
+	transports        []Transport             // shared listeners every terminal can connect to
+	perTerminalSocket bool                    // also give every terminal its own unix socket
+	socketMode        os.FileMode             // permissions of the unix sockets
+	sockets           map[string]net.Listener // per terminal sockets by terminal id
+	events            chan common.TerminalEvent
+	watchdogConf      common.WatchdogConfig
+	runtimes          map[string]TerminalRuntime
+	defaultRuntime    string              // for deployments that don't name one
+	bases             *baseStore          // mt4/mt5 installs new terminals are cloned from
+	accounts          map[string][]string // login@server -> terminal ids, usually just one
 	terminals         map[string]*Terminal
+	responses         chan common.TaskRes // results from every terminal, drained by the task handler
+	responseTTL       time.Duration       // unacked result files older than this are removed
+	queueConf         common.TerminalQueueConfig
+	maxFrameSize      int  // largest message accepted from an EA
+	allowFramed       bool // let EAs switch to length prefixed frames after the handshake
 	ctx               context.Context
 	cancel            context.CancelFunc
 }
 
-func NewTerminalConnector(terminalRawTcpUrl string) (*TerminalConnector, error) {
-	return &TerminalConnector{
-		accounts:          make(map[string]accountType),
+func NewTerminalConnector(conf common.ControllerConfig) (*TerminalConnector, error) {
+	tc := &TerminalConnector{
+		accounts:          make(map[string][]string),
 		terminals:         make(map[string]*Terminal),
-		terminalRawTcpUrl: terminalRawTcpUrl,
-	}, nil
-}
+		responses:         make(chan common.TaskRes, 256),
+		responseTTL:       conf.ResponseFileTTL,
+		queueConf:         conf.TerminalQueue,
+		maxFrameSize:      conf.TerminalFraming.MaxFrameSize,
+		allowFramed:       conf.TerminalFraming.AllowFramed,
+		perTerminalSocket: conf.TerminalListen.PerTerminalSocket,
+		socketMode:        conf.TerminalListen.SocketMode,
+		sockets:           make(map[string]net.Listener),
+		events:            make(chan common.TerminalEvent, 256),
+		watchdogConf:      conf.Watchdog,
+		terminalRawTcpUrl: conf.TerminalRawTcpUrl,
+		defaultRuntime:    conf.TerminalRuntime,
+		bases:             newBaseStore(conf.BasesDir),
+		runtimes: map[string]TerminalRuntime{
+			RuntimeFake:   NewFakeRuntime(),
+			RuntimePodman: newPodmanClient(conf.Podman, nil),
+		},
+	}
 
-func (tc *TerminalConnector) Run(parentCtx context.Context) error {
-	listener, err := net.Listen("tcp", tc.terminalRawTcpUrl)
-	if err != nil {
-		return fmt.Errorf("listen failed: %v", err)
+	// raw processes report their exits back to us
+	tc.runtimes[RuntimeRaw] = &rawRuntime{supervisor: newSupervisor(conf.Supervisor, tc.processExited)}
+
+	if tc.defaultRuntime == "" {
+		tc.defaultRuntime = RuntimeRaw
+	}
+	if _, ok := tc.runtimes[tc.defaultRuntime]; !ok {
+		return nil, fmt.Errorf("[ctrl] unknown terminal runtime %s", tc.defaultRuntime)
 	}
 
-	defer listener.Close()
-	log.Printf("[ctrl] terminal connector listening on: %s", tc.terminalRawTcpUrl)
-	tc.ctx, tc.cancel = context.WithCancel(parentCtx)
+	if conf.TerminalRawTcpUrl != "" {
+		transport, err := ParseTransport(conf.TerminalRawTcpUrl)
+		if err != nil {
+			return nil, err
+		}
+		transport.Mode = tc.socketMode
+		tc.transports = append(tc.transports, transport)
+	}
 
-	// want this one to block
-	tc.acceptNewConnections(listener)
+	if conf.TerminalListen.UnixSocket != "" {
+		tc.transports = append(tc.transports, Transport{
+			Network: "unix",
+			Address: conf.TerminalListen.UnixSocket,
+			Mode:    tc.socketMode,
+		})
+	}
 
-	return nil
+	if tc.watchdogConf.StaleAfter <= 0 {
+		tc.watchdogConf.StaleAfter = DefaultWatchdog.StaleAfter
+	}
+	if tc.watchdogConf.RestartAfter <= 0 {
+		tc.watchdogConf.RestartAfter = DefaultWatchdog.RestartAfter
+	}
+	if tc.watchdogConf.MaxRestarts <= 0 {
+		tc.watchdogConf.MaxRestarts = DefaultWatchdog.MaxRestarts
+	}
+
+	if tc.maxFrameSize <= 0 {
+		tc.maxFrameSize = defaultMaxFrameSize
+	}
+
+	// terminals can be registered before Run, they hang off this context
+	tc.ctx, tc.cancel = context.WithCancel(context.Background())
+	return tc, nil
 }
 
-func (tc *TerminalConnector) acceptNewConnections(listener net.Listener) {
-	for {
-		conn, err := listener.Accept()
+func (tc *TerminalConnector) Run(parentCtx context.Context) error {
+	if len(tc.transports) == 0 && !tc.perTerminalSocket {
+		return fmt.Errorf("no terminal transports configured")
+	}
 
-		if err != nil {
-			select {
-			case <-tc.ctx.Done():
-				return
-			default:
-				log.Printf("[ctrl] accept new terminal conn err: %v", err)
-				time.Sleep(200 * time.Millisecond)
-				continue
-			}
+	// before listening, an EA reconnecting right away has to find its terminal
+	if err := tc.Reload(); err != nil {
+		tc.cancel()
+		return err
+	}
+
+	for _, transport := range tc.transports {
+		if _, err := tc.serve(transport); err != nil {
+			tc.cancel()
+			return err
 		}
+	}
+
+	go tc.collectStaleResponses(tc.ctx)
+	go tc.watchdog(tc.ctx)
 
-		// pass this new connection on to the respective terminal
-		go tc.handleIncomingConnection(&conn)
+	// stop everything when the controller does, want this one to block
+	select {
+	case <-parentCtx.Done():
+		tc.cancel()
+	case <-tc.ctx.Done():
 	}
+
+	return nil
 }
 
-func (tc *TerminalConnector) handleIncomingConnection(conn *net.Conn) {
+func (tc *TerminalConnector) handleIncomingConnection(conn *net.Conn, transport Transport) {
 	remote := (*conn).RemoteAddr().String()
+	if remote == "" || remote == "@" {
+		// unix peers have no address
+		remote = transport.String()
+	}
 
-	terminal, err := tc.performHandshake(conn)
+	terminal, codec, err := tc.performHandshake(conn, transport)
 	if err != nil {
 		log.Printf("[ctrl] handshake failed from %s: %v", remote, err)
 		(*conn).Close()
 		return
 	}
 
-	terminal.HandleConnection(tc.ctx, conn)
+	terminal.HandleConnection(conn, codec)
 }
 
-func (tc *TerminalConnector) performHandshake(conn *net.Conn) (term *Terminal, err error) {
-	_ = (*conn).SetDeadline(time.Now().Add(200 * time.Millisecond))
+// performHandshake authenticates the EA and agrees on the framing, the handshake itself is always ndjson
+func (tc *TerminalConnector) performHandshake(conn *net.Conn, transport Transport) (term *Terminal, codec frameCodec, err error) {
+	_ = (*conn).SetDeadline(time.Now().Add(2 * time.Second))
 	defer (*conn).SetDeadline(time.Time{})
 
-	decoder := json.NewDecoder(*conn)
+	remote := (*conn).RemoteAddr().String()
+	if remote == "" || remote == "@" {
+		// unix peers have no address
+		remote = transport.String()
+	}
+
+	// the reader is handed over to the connection, anything buffered past the handshake is kept
+	reader := bufio.NewReaderSize(*conn, 64*1024)
+	handshake := newNDJSONCodec(*conn, reader, tc.maxFrameSize)
+
 	var res common.TaskRes
-	if err := decoder.Decode(&res); err != nil {
-		return nil, err
+	if err := readJSON(handshake, &res); err != nil {
+		return nil, nil, err
 	}
 
 	if res.MiscDetails == nil {
-		return nil, fmt.Errorf("[ctrl] invalid handshake msg")
+		return nil, nil, fmt.Errorf("[ctrl] invalid handshake msg")
+	}
+
+	terminalId := res.MiscDetails.TerminalId
+	if transport.TerminalId != "" && transport.TerminalId != terminalId {
+		log.Printf("[ctrl] rejected terminal %s on the socket of terminal %s", terminalId, transport.TerminalId)
+		return nil, nil, fmt.Errorf("[ctrl] terminal %s can't use this socket", terminalId)
+	}
+
+	terminal, ok := tc.Get(terminalId)
+	if !ok {
+		return nil, nil, fmt.Errorf("[ctrl] terminal not found")
+	}
+
+	// knowing a terminal id is not enough, the EA has to prove it holds the secret we deployed with it
+	nonce, err := generateNonce()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if terminal, ok := tc.GetTerminal(res.MiscDetails.TerminalId); !ok {
-		return nil, fmt.Errorf("[ctrl] terminal not found")
-	} else {
-		return terminal, nil
+	if err := writeJSON(handshake, authChallenge{Type: "challenge", Nonce: nonce}); err != nil {
+		return nil, nil, err
 	}
+
+	var auth authResponse
+	if err := readJSON(handshake, &auth); err != nil {
+		return nil, nil, fmt.Errorf("[ctrl] no auth response from terminal %s: %v", terminalId, err)
+	}
+
+	if auth.Type != "auth" || !terminal.verifyAuth(nonce, auth.Hmac) {
+		log.Printf("[ctrl] rejected impostor for terminal %s from %s", terminalId, remote)
+		return nil, nil, fmt.Errorf("[ctrl] terminal %s failed authentication", terminalId)
+	}
+
+	framing := negotiateFraming(auth.Framing, tc.allowFramed)
+	if err := writeJSON(handshake, authResult{Type: "auth_ok", Framing: framing}); err != nil {
+		return nil, nil, err
+	}
+
+	return terminal, newCodec(framing, *conn, reader, tc.maxFrameSize), nil
 }
 
-func (tc *TerminalConnector) GetTerminal(id string) (terminal *Terminal, ok bool) {
-	tc.mu.Lock()
-	defer tc.mu.Unlock()
+func readJSON(codec frameCodec, v any) error {
+	msg, err := codec.ReadMessage()
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(msg, v)
+}
+
+func writeJSON(codec frameCodec, v any) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
 
-	terminal, ok = tc.terminals[id]
-	return
+	return codec.WriteMessage(msg)
 }
 
-// add functions for all account related actions
+// eaAddress is where the EA of the terminal should connect to
+func (tc *TerminalConnector) eaAddress(terminalId string) (string, error) {
+	if tc.perTerminalSocket {
+		dir, err := terminalDirFor(terminalId)
+		if err != nil {
+			return "", err
+		}
+
+		return Transport{Network: "unix", Address: terminalSocket(dir)}.EAAddress(), nil
+	}
+
+	if len(tc.transports) == 0 {
+		return "", fmt.Errorf("no terminal transports configured")
+	}
+
+	return tc.transports[0].EAAddress(), nil
+}
+
+// openTerminalSocket starts the per terminal socket, a no-op if those are disabled or it is already open
+func (tc *TerminalConnector) openTerminalSocket(terminalId string) error {
+	if !tc.perTerminalSocket {
+		return nil
+	}
 
-func (tc *TerminalConnector) AddAccount(id string, login int, server string) {
 	tc.mu.Lock()
 	defer tc.mu.Unlock()
 
-	tc.accounts[id] = accountType{
-		Login:  login,
-		Server: server,
+	if _, ok := tc.sockets[terminalId]; ok {
+		return nil
+	}
+
+	dir, err := terminalDirFor(terminalId)
+	if err != nil {
+		return err
+	}
+
+	listener, err := tc.serve(Transport{
+		Network:    "unix",
+		Address:    terminalSocket(dir),
+		Mode:       tc.socketMode,
+		TerminalId: terminalId,
+	})
+	if err != nil {
+		return err
 	}
+
+	tc.sockets[terminalId] = listener
+	return nil
 }
 
-func (tc *TerminalConnector) RemoveAccount(id string) {
+func (tc *TerminalConnector) closeTerminalSocket(terminalId string) {
 	tc.mu.Lock()
-	defer tc.mu.Unlock()
+	listener, ok := tc.sockets[terminalId]
+	delete(tc.sockets, terminalId)
+	tc.mu.Unlock()
+
+	if ok {
+		listener.Close()
+	}
+}
 
-	delete(tc.accounts, id)
+// Inventory lists every known terminal, reported to the server after connecting
+func (tc *TerminalConnector) Inventory() common.Inventory {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+
+	inv := common.Inventory{Terminals: make([]common.InventoryItem, 0, len(tc.terminals))}
+	for _, term := range tc.terminals {
+		term.mu.RLock()
+		inv.Terminals = append(inv.Terminals, common.InventoryItem{
+			TerminalId: term.Id,
+			Type:       term.Type,
+			AccountId:  term.login,
+			Server:     term.server,
+		})
+		term.mu.RUnlock()
+	}
+
+	return inv
 }
 
+// Responses fans in the results of every terminal. Terminals block when nobody drains it,
+// so a slow server link pushes back on the EAs instead of losing results
+func (tc *TerminalConnector) Responses() <-chan common.TaskRes {
+	return tc.responses
+}
+
+// SendToTerminal queues the task on the terminal named in it, or the one hosting the account when
+// only the login and server are given
 func (tc *TerminalConnector) SendToTerminal(req common.TaskReq) error {
 	if req.MiscDetails == nil {
-		return fmt.Errorf("[ctrl] invalid request - missing terminal id")
+		return fmt.Errorf("[ctrl] invalid request - missing terminal id or account")
 	}
 
-	termId := req.MiscDetails.TerminalId
+	// don't hold the registry while queueing, one stuck terminal shouldn't hold up the others
+	terminal, err := tc.Resolve(req.MiscDetails)
+	if err != nil {
+		return err
+	}
 
-	tc.mu.Lock()
-	defer tc.mu.Unlock()
+	termId := terminal.Id
+	if req.MiscDetails.TerminalId == "" {
+		misc := *req.MiscDetails
+		misc.TerminalId = termId
+		req.MiscDetails = &misc
+	}
 
-	if terminal, ok := tc.terminals[termId]; ok {
-		terminal.SendTask(req)
+	if state := terminal.State(); state != StateOnline {
+		return fmt.Errorf("[ctrl] terminal %s is %s", termId, state)
 	}
 
-	return nil
+	return terminal.SendTask(req)
 }
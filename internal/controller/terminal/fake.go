@@ -0,0 +1,112 @@
+package terminal
+
+import (
+	"fmt"
+	"sync"
+)
+
+// FakeRuntime keeps terminals in memory only, for tests and dry runs. Nothing is started,
+// the EA connection has to be simulated separately
+type FakeRuntime struct {
+	mu       sync.Mutex
+	statuses map[string]RuntimeStatus
+	logs     map[string][]byte
+
+	// returned by the matching call when set
+	FailPrepare error
+	FailStart   error
+	FailStop    error
+
+	calls []string // "<call> <terminal id>" in order
+}
+
+func NewFakeRuntime() *FakeRuntime {
+	return &FakeRuntime{
+		statuses: make(map[string]RuntimeStatus),
+		logs:     make(map[string][]byte),
+	}
+}
+
+func (f *FakeRuntime) Name() string {
+	return RuntimeFake
+}
+
+// Calls returns the calls made so far as "<call> <terminal id>", oldest first
+func (f *FakeRuntime) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func (f *FakeRuntime) record(call string, pod *PodmanDetails) {
+	f.calls = append(f.calls, call+" "+pod.terminalId)
+	f.logs[pod.terminalId] = append(f.logs[pod.terminalId], fmt.Sprintf("%s\n", call)...)
+}
+
+func (f *FakeRuntime) Prepare(pod *PodmanDetails) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.record("prepare", pod)
+	if f.FailPrepare != nil {
+		return f.FailPrepare
+	}
+
+	f.statuses[pod.terminalId] = RuntimeCreated
+	return nil
+}
+
+func (f *FakeRuntime) Start(pod *PodmanDetails) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.record("start", pod)
+	if f.FailStart != nil {
+		return f.FailStart
+	}
+
+	f.statuses[pod.terminalId] = RuntimeRunning
+	return nil
+}
+
+func (f *FakeRuntime) Stop(pod *PodmanDetails) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.record("stop", pod)
+	if f.FailStop != nil {
+		return f.FailStop
+	}
+
+	if f.statuses[pod.terminalId] == RuntimeRunning {
+		f.statuses[pod.terminalId] = RuntimeStopped
+	}
+	return nil
+}
+
+func (f *FakeRuntime) Status(pod *PodmanDetails) (RuntimeStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	status, ok := f.statuses[pod.terminalId]
+	if !ok {
+		return RuntimeUnknown, nil
+	}
+
+	return status, nil
+}
+
+func (f *FakeRuntime) Logs(pod *PodmanDetails, lines int) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return tailLines(f.logs[pod.terminalId], lines), nil
+}
+
+func (f *FakeRuntime) Destroy(pod *PodmanDetails) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.record("destroy", pod)
+	f.statuses[pod.terminalId] = RuntimeRemoved
+	return nil
+}
@@ -0,0 +1,165 @@
+package terminal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"slices"
+)
+
+// framing modes of the terminal socket. Every EA starts with ndjson for the handshake and
+// switches to the framed mode after auth_ok if both sides agreed on it
+const (
+	FramingNDJSON = "ndjson"
+	FramingLength = "length_crc32" // 4 byte big endian length + 4 byte crc32 (IEEE) of the payload, then the payload
+)
+
+const (
+	defaultMaxFrameSize = 1 << 20
+	frameHeaderSize     = 8
+	maxDecodeErrors     = 5 // consecutive bad messages before we give up on the connection
+)
+
+var (
+	ErrFrameTooLarge = errors.New("frame too large")
+	ErrBadChecksum   = errors.New("frame checksum mismatch")
+)
+
+// frameCodec reads and writes whole messages on the terminal socket.
+// Errors other than ErrBadChecksum mean the stream can't be trusted anymore
+type frameCodec interface {
+	ReadMessage() ([]byte, error)
+	WriteMessage(msg []byte) error
+	Mode() string
+}
+
+type ndjsonCodec struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	maxSize int
+}
+
+func newNDJSONCodec(conn net.Conn, reader *bufio.Reader, maxSize int) *ndjsonCodec {
+	return &ndjsonCodec{conn: conn, reader: reader, maxSize: maxSize}
+}
+
+func (c *ndjsonCodec) Mode() string {
+	return FramingNDJSON
+}
+
+// ReadMessage returns the next line without the newline, lines over maxSize fail with ErrFrameTooLarge
+func (c *ndjsonCodec) ReadMessage() ([]byte, error) {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		// blank lines are keep-alives from older EAs
+		if len(bytes.TrimSpace(line)) > 0 {
+			return line, nil
+		}
+	}
+}
+
+func (c *ndjsonCodec) readLine() ([]byte, error) {
+	var line []byte
+
+	for {
+		chunk, err := c.reader.ReadSlice('\n')
+		if len(line)+len(chunk) > c.maxSize+1 {
+			return nil, fmt.Errorf("%w: line over %d bytes", ErrFrameTooLarge, c.maxSize)
+		}
+
+		line = append(line, chunk...)
+
+		if err == nil {
+			return bytes.TrimRight(line, "\r\n"), nil
+		}
+
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+	}
+}
+
+func (c *ndjsonCodec) WriteMessage(msg []byte) error {
+	_, err := c.conn.Write(append(msg, '\n'))
+	return err
+}
+
+type lengthCodec struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	maxSize int
+}
+
+func newLengthCodec(conn net.Conn, reader *bufio.Reader, maxSize int) *lengthCodec {
+	return &lengthCodec{conn: conn, reader: reader, maxSize: maxSize}
+}
+
+func (c *lengthCodec) Mode() string {
+	return FramingLength
+}
+
+func (c *lengthCodec) ReadMessage() ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:4])
+	sum := binary.BigEndian.Uint32(header[4:])
+
+	// we can't skip it without reading it all, so the connection goes
+	if size > uint32(c.maxSize) {
+		return nil, fmt.Errorf("%w: %d bytes, max is %d", ErrFrameTooLarge, size, c.maxSize)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(payload) != sum {
+		return nil, ErrBadChecksum
+	}
+
+	return payload, nil
+}
+
+func (c *lengthCodec) WriteMessage(msg []byte) error {
+	if len(msg) > c.maxSize {
+		return fmt.Errorf("%w: %d bytes, max is %d", ErrFrameTooLarge, len(msg), c.maxSize)
+	}
+
+	frame := make([]byte, frameHeaderSize+len(msg))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(msg)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(msg))
+	copy(frame[frameHeaderSize:], msg)
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// negotiateFraming picks the framing for the rest of the connection from what the EA offered
+func negotiateFraming(offered []string, allowFramed bool) string {
+	if allowFramed && slices.Contains(offered, FramingLength) {
+		return FramingLength
+	}
+
+	return FramingNDJSON
+}
+
+func newCodec(mode string, conn net.Conn, reader *bufio.Reader, maxSize int) frameCodec {
+	if mode == FramingLength {
+		return newLengthCodec(conn, reader, maxSize)
+	}
+
+	return newNDJSONCodec(conn, reader, maxSize)
+}
@@ -0,0 +1,195 @@
+package terminal
+
+import (
+	"backend/internal/common"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TaskPolicy is how long we wait on a terminal for a task result and how often we retry it
+type TaskPolicy struct {
+	common.RetryPolicy
+	// SafeRetry asks the EA for the request status before resending, for tasks that must not run twice
+	SafeRetry bool
+}
+
+var defaultTaskPolicy = TaskPolicy{
+	RetryPolicy: common.RetryPolicy{Timeout: 10 * time.Second, MaxAttempts: 3},
+}
+
+// DefaultTaskPolicies are used for subtypes sent to terminals, anything missing uses defaultTaskPolicy
+var DefaultTaskPolicies = map[common.TaskSubType]TaskPolicy{
+	common.TradeTaskAdd: {RetryPolicy: common.RetryPolicy{Timeout: 10 * time.Second, MaxAttempts: 3}, SafeRetry: true},
+	common.TradeTaskMod: {RetryPolicy: common.RetryPolicy{Timeout: 10 * time.Second, MaxAttempts: 3}, SafeRetry: true},
+
+	common.DataTaskSymbol:    {RetryPolicy: common.RetryPolicy{Timeout: 5 * time.Second, MaxAttempts: 3}},
+	common.DataTaskPrice:     {RetryPolicy: common.RetryPolicy{Timeout: 3 * time.Second, MaxAttempts: 3}},
+	common.DataTaskAccount:   {RetryPolicy: common.RetryPolicy{Timeout: 5 * time.Second, MaxAttempts: 3}},
+	common.DataTaskTrades:    {RetryPolicy: common.RetryPolicy{Timeout: 10 * time.Second, MaxAttempts: 3}},
+	common.DataTaskPriceFeed: {RetryPolicy: common.RetryPolicy{Timeout: 5 * time.Second, MaxAttempts: 3}},
+}
+
+type inflightTask struct {
+	seq       uint64
+	task      common.TaskReq
+	policy    TaskPolicy
+	attempts  int
+	firstSent time.Time
+	deadline  time.Time
+}
+
+// inflightTracker holds the tasks sent to a terminal that haven't been answered yet
+type inflightTracker struct {
+	mu       sync.Mutex
+	policies map[common.TaskSubType]TaskPolicy
+	nextSeq  uint64
+	items    map[int]*inflightTask
+}
+
+func newInflightTracker(policies map[common.TaskSubType]TaskPolicy) *inflightTracker {
+	if policies == nil {
+		policies = DefaultTaskPolicies
+	}
+
+	return &inflightTracker{
+		policies: policies,
+		items:    make(map[int]*inflightTask),
+	}
+}
+
+func (it *inflightTracker) policyFor(subType common.TaskSubType) TaskPolicy {
+	if policy, ok := it.policies[subType]; ok {
+		return policy
+	}
+
+	return defaultTaskPolicy
+}
+
+func (it *inflightTracker) track(task common.TaskReq) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	now := time.Now()
+	policy := it.policyFor(task.ReqSubType)
+
+	if existing, ok := it.items[task.Id]; ok {
+		// the server retried it, start over
+		existing.task = task
+		existing.attempts = 1
+		existing.deadline = now.Add(policy.Timeout)
+		return
+	}
+
+	it.items[task.Id] = &inflightTask{
+		seq:       it.nextSeq,
+		task:      task,
+		policy:    policy,
+		attempts:  1,
+		firstSent: now,
+		deadline:  now.Add(policy.Timeout),
+	}
+	it.nextSeq++
+}
+
+// resolve looks at a terminal result. Answers to our status queries are consumed here (forward is false),
+// resend holds the original task when the EA never saw it
+func (it *inflightTracker) resolve(res common.TaskRes) (forward bool, resend *common.TaskReq) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	entry, ok := it.items[res.ReqId]
+
+	if res.ReqSubType != string(common.TradeTaskStatus) {
+		if ok {
+			delete(it.items, res.ReqId)
+		}
+		return true, nil
+	}
+
+	if !ok {
+		return false, nil
+	}
+
+	var status common.TradeStatusPayload
+	if err := json.Unmarshal(res.Payload, &status); err != nil || res.Err != "" {
+		// treat it like no answer, the next deadline asks again
+		return false, nil
+	}
+
+	entry.deadline = time.Now().Add(entry.policy.Timeout)
+	if status.Seen {
+		// executed or executing, the result itself is still on its way
+		return false, nil
+	}
+
+	task := entry.task
+	return false, &task
+}
+
+// due returns what to send for every task past its deadline, in the order they were first sent.
+// Safe tasks get a status query instead of the task itself, tasks out of attempts come back in expired
+func (it *inflightTracker) due(now time.Time) (send []common.TaskReq, expired []inflightTask) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	due := make([]*inflightTask, 0)
+	for _, entry := range it.items {
+		if !now.Before(entry.deadline) {
+			due = append(due, entry)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool { return due[i].seq < due[j].seq })
+
+	for _, entry := range due {
+		if entry.attempts >= entry.policy.MaxAttempts {
+			delete(it.items, entry.task.Id)
+			expired = append(expired, *entry)
+			continue
+		}
+
+		entry.attempts++
+		entry.deadline = now.Add(entry.policy.Timeout)
+
+		if entry.policy.SafeRetry {
+			send = append(send, statusQuery(entry.task))
+		} else {
+			send = append(send, entry.task)
+		}
+	}
+
+	return send, expired
+}
+
+func (it *inflightTracker) forget(id int) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	delete(it.items, id)
+}
+
+// drain forgets every task and returns them, used when the terminal is given up on
+func (it *inflightTracker) drain() []inflightTask {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	drained := make([]inflightTask, 0, len(it.items))
+	for _, entry := range it.items {
+		drained = append(drained, *entry)
+	}
+
+	sort.Slice(drained, func(i, j int) bool { return drained[i].seq < drained[j].seq })
+	it.items = make(map[int]*inflightTask)
+
+	return drained
+}
+
+func statusQuery(task common.TaskReq) common.TaskReq {
+	return common.TaskReq{
+		Id:          task.Id,
+		ReqType:     common.TradeTask,
+		ReqSubType:  common.TradeTaskStatus,
+		MiscDetails: task.MiscDetails,
+	}
+}
@@ -0,0 +1,231 @@
+package terminal
+
+import (
+	"backend/internal/common"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	unloadTimeout = 10 * time.Second // longest we wait for the EA to confirm an unload
+	unloadSilence = 2 * time.Second  // an EA that goes quiet this long after the unload is taken as done
+	startTimeout  = 2 * time.Minute  // how long Start waits for the EA to connect back
+)
+
+// Start launches a stopped (or failed) terminal and blocks until its EA is online.
+// On a timeout the terminal stays awaiting-connect so the watchdog keeps an eye on it
+func (term *Terminal) Start(ctx context.Context) error {
+	term.opMu.Lock()
+	defer term.opMu.Unlock()
+
+	ctx, done := term.cancelableStart(ctx)
+	defer done()
+
+	term.mu.Lock()
+	state, pod := term.state, term.pod
+
+	switch state {
+	case StateOnline:
+		term.mu.Unlock()
+		return nil
+	case StateAwaitingConnect:
+		// already launched, just wait for it
+		term.mu.Unlock()
+		return term.waitOnline(ctx)
+	}
+
+	if pod == nil {
+		term.mu.Unlock()
+		return fmt.Errorf("[ctrl] terminal %s has no deployment to start", term.Id)
+	}
+
+	if !term.setStateLocked(StateStarting) {
+		term.mu.Unlock()
+		return fmt.Errorf("[ctrl] can't start terminal %s while %s", term.Id, state)
+	}
+	term.mu.Unlock()
+
+	log.Printf("[ctrl] starting terminal %s", term.Id)
+
+	if err := runTerminal(pod); err != nil {
+		term.setState(StateFailed)
+		return fmt.Errorf("[ctrl] failed to start terminal %s: %v", term.Id, err)
+	}
+
+	term.setState(StateAwaitingConnect)
+	return term.waitOnline(ctx)
+}
+
+func (term *Terminal) waitOnline(ctx context.Context) error {
+	err := term.waitForState(ctx, StateOnline, startTimeout)
+	if errors.Is(err, context.Canceled) {
+		return fmt.Errorf("[ctrl] start of terminal %s interrupted by a stop", term.Id)
+	}
+
+	return err
+}
+
+// cancelableStart lets cancelStart end the wait of the Start running under opMu
+func (term *Terminal) cancelableStart(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	term.mu.Lock()
+	term.startCancel = cancel
+	term.mu.Unlock()
+
+	return ctx, func() {
+		term.mu.Lock()
+		term.startCancel = nil
+		term.mu.Unlock()
+		cancel()
+	}
+}
+
+func (term *Terminal) cancelStart() {
+	term.mu.Lock()
+	defer term.mu.Unlock()
+
+	if term.startCancel != nil {
+		log.Printf("[ctrl] stopping terminal %s, no longer waiting for it to start", term.Id)
+		term.startCancel()
+	}
+}
+
+// Stop unloads the EA and halts the terminal process. A full stop also removes the pod,
+// a temporary one leaves it in place for Start
+func (term *Terminal) Stop(ctx context.Context, full bool) error {
+	// a Start waiting for the EA would hold opMu for up to startTimeout
+	term.cancelStart()
+
+	term.opMu.Lock()
+	defer term.opMu.Unlock()
+
+	term.mu.Lock()
+	state, pod := term.state, term.pod
+	connected := term.conn != nil
+
+	// a stopped terminal only has something left to do when the pod goes too
+	if state == StateStopped && !full {
+		term.mu.Unlock()
+		return nil
+	}
+
+	if !term.setStateLocked(StateStopping) {
+		term.mu.Unlock()
+		return fmt.Errorf("[ctrl] can't stop terminal %s while %s", term.Id, state)
+	}
+	term.mu.Unlock()
+
+	log.Printf("[ctrl] stopping terminal %s (full %v)", term.Id, full)
+
+	if connected {
+		term.unload(ctx)
+	}
+
+	term.dropConnection()
+
+	if pod != nil {
+		if err := stopTerminal(pod, full); err != nil {
+			term.setState(StateFailed)
+			return fmt.Errorf("[ctrl] failed to stop terminal %s: %v", term.Id, err)
+		}
+	}
+
+	term.setState(StateStopped)
+	return nil
+}
+
+// Restart is a temporary stop followed by a start
+func (term *Terminal) Restart(ctx context.Context) error {
+	if err := term.Stop(ctx, false); err != nil {
+		return err
+	}
+
+	return term.Start(ctx)
+}
+
+// unload asks the EA to remove itself and waits for its confirmation, or for it to go quiet
+func (term *Terminal) unload(ctx context.Context) {
+	// a confirmation left over from an earlier stop doesn't count
+	select {
+	case <-term.unloaded:
+	default:
+	}
+
+	term.send(common.TaskReq{ReqType: common.AccountTask, ReqSubType: common.AccountTaskUnload})
+	sent := time.Now()
+
+	timeout := time.NewTimer(unloadTimeout)
+	defer timeout.Stop()
+
+	ticker := time.NewTicker(unloadSilence / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-term.unloaded:
+			return
+		case <-timeout.C:
+			log.Printf("[ctrl] terminal %s did not confirm the unload in %s, stopping anyway", term.Id, unloadTimeout)
+			return
+		case now := <-ticker.C:
+			lastSeen := term.LastSeen()
+			if lastSeen.Before(sent) {
+				lastSeen = sent
+			}
+
+			if now.Sub(lastSeen) > unloadSilence {
+				return
+			}
+		}
+	}
+}
+
+// StartTerminal starts the terminal named in misc, see Terminal.Start
+func (tc *TerminalConnector) StartTerminal(misc *common.TerminalMiscData) (*Terminal, error) {
+	term, err := tc.Resolve(misc)
+	if err != nil {
+		return nil, err
+	}
+
+	tc.forgetCrashes(term.Id)
+	return term, term.Start(tc.ctx)
+}
+
+// StopTerminal stops the terminal named in misc, see Terminal.Stop
+func (tc *TerminalConnector) StopTerminal(misc *common.TerminalMiscData, full bool) (*Terminal, error) {
+	term, err := tc.Resolve(misc)
+	if err != nil {
+		return nil, err
+	}
+
+	return term, term.Stop(tc.ctx, full)
+}
+
+// RestartTerminal restarts the terminal named in misc, see Terminal.Restart
+func (tc *TerminalConnector) RestartTerminal(misc *common.TerminalMiscData) (*Terminal, error) {
+	term, err := tc.Resolve(misc)
+	if err != nil {
+		return nil, err
+	}
+
+	tc.forgetCrashes(term.Id)
+	return term, term.Restart(tc.ctx)
+}
+
+// forgetCrashes gives the terminal a fresh crash budget, only for starts a user asked for.
+// Watchdog restarts keep counting so a crash loop still ends in the failed state
+func (tc *TerminalConnector) forgetCrashes(terminalId string) {
+	tc.mu.RLock()
+	runtime, ok := tc.runtimes[RuntimeRaw].(*rawRuntime)
+	tc.mu.RUnlock()
+
+	if ok {
+		runtime.supervisor.forget(terminalId)
+	}
+}
@@ -0,0 +1,216 @@
+package terminal
+
+import (
+	"backend/internal/common"
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestConnector(t *testing.T) (*TerminalConnector, *FakeRuntime) {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+
+	tc, err := NewTerminalConnector(common.ControllerConfig{
+		TerminalRawTcpUrl: "tcp://127.0.0.1:0",
+		TerminalRuntime:   RuntimeFake,
+		BasesDir:          t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("connector: %v", err)
+	}
+	t.Cleanup(tc.cancel)
+
+	fake := NewFakeRuntime()
+	tc.RegisterRuntime(fake)
+	return tc, fake
+}
+
+// connectWhenLaunched plays the EA, it comes online once the terminal is awaiting it
+func connectWhenLaunched(t *testing.T, term *Terminal) {
+	t.Helper()
+
+	go func() {
+		if err := term.waitForState(context.Background(), StateAwaitingConnect, 5*time.Second); err != nil {
+			t.Errorf("terminal never launched: %v", err)
+			return
+		}
+		term.setState(StateOnline)
+	}()
+}
+
+func assertRuntime(t *testing.T, fake *FakeRuntime, term *Terminal, state TerminalState, status RuntimeStatus, calls ...string) {
+	t.Helper()
+
+	if got := term.State(); got != state {
+		t.Errorf("terminal is %s, want %s", got, state)
+	}
+	if got, _ := fake.Status(term.pod); got != status {
+		t.Errorf("runtime status is %s, want %s", got, status)
+	}
+	if got := fake.Calls(); !slices.Equal(got, calls) {
+		t.Errorf("runtime calls are %v, want %v", got, calls)
+	}
+}
+
+func TestTerminalLifecycle(t *testing.T) {
+	tc, fake := newTestConnector(t)
+	ctx := context.Background()
+
+	term, err := tc.Register(TerminalDeploy{Id: "abc", Type: common.MT5, Login: 1001, Server: "Demo-1"})
+	if err != nil {
+		t.Fatalf("deploy: %v", err)
+	}
+	assertRuntime(t, fake, term, StateAwaitingConnect, RuntimeRunning, "prepare abc", "start abc")
+
+	term.setState(StateOnline)
+
+	if err := term.Stop(ctx, false); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	assertRuntime(t, fake, term, StateStopped, RuntimeStopped, "prepare abc", "start abc", "stop abc")
+
+	connectWhenLaunched(t, term)
+	if err := term.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	assertRuntime(t, fake, term, StateOnline, RuntimeRunning, "prepare abc", "start abc", "stop abc", "start abc")
+
+	connectWhenLaunched(t, term)
+	if err := term.Restart(ctx); err != nil {
+		t.Fatalf("restart: %v", err)
+	}
+	assertRuntime(t, fake, term, StateOnline, RuntimeRunning,
+		"prepare abc", "start abc", "stop abc", "start abc", "stop abc", "start abc")
+
+	// a full stop removes the pod as well
+	if err := term.Stop(ctx, true); err != nil {
+		t.Fatalf("full stop: %v", err)
+	}
+	assertRuntime(t, fake, term, StateStopped, RuntimeRemoved,
+		"prepare abc", "start abc", "stop abc", "start abc", "stop abc", "start abc", "stop abc", "destroy abc")
+}
+
+func TestTerminalStartFailure(t *testing.T) {
+	tc, fake := newTestConnector(t)
+	ctx := context.Background()
+
+	term, err := tc.Register(TerminalDeploy{Id: "abc", Type: common.MT4, Login: 1001, Server: "Demo-1"})
+	if err != nil {
+		t.Fatalf("deploy: %v", err)
+	}
+
+	if err := term.Stop(ctx, false); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+
+	fake.FailStart = errors.New("no display")
+	if err := term.Start(ctx); err == nil {
+		t.Fatal("expected the start to fail")
+	}
+	if got := term.State(); got != StateFailed {
+		t.Errorf("terminal is %s after a failed start, want failed", got)
+	}
+
+	// a failed terminal can be started again once the runtime recovers
+	fake.FailStart = nil
+	connectWhenLaunched(t, term)
+	if err := term.Start(ctx); err != nil {
+		t.Fatalf("start after failure: %v", err)
+	}
+	if got := term.State(); got != StateOnline {
+		t.Errorf("terminal is %s, want online", got)
+	}
+}
+
+func TestDeployFailure(t *testing.T) {
+	tc, fake := newTestConnector(t)
+	fake.FailPrepare = errors.New("no image")
+
+	term, err := tc.Register(TerminalDeploy{Id: "abc", Type: common.MT5, Login: 1001, Server: "Demo-1"})
+	if err == nil {
+		t.Fatal("expected the deploy to fail")
+	}
+	if term == nil || term.State() != StateFailed {
+		t.Fatalf("a failed deploy should stay registered as failed, got %v", term)
+	}
+	if got := fake.Calls(); !slices.Equal(got, []string{"prepare abc"}) {
+		t.Errorf("runtime calls are %v", got)
+	}
+}
+
+func TestStopInterruptsStart(t *testing.T) {
+	tc, _ := newTestConnector(t)
+	ctx := context.Background()
+
+	term, err := tc.Register(TerminalDeploy{Id: "abc", Type: common.MT5, Login: 1001, Server: "Demo-1"})
+	if err != nil {
+		t.Fatalf("deploy: %v", err)
+	}
+
+	// the EA never connects, Start would wait for startTimeout
+	started := make(chan error, 1)
+	go func() { started <- term.Start(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		term.mu.RLock()
+		waiting := term.startCancel != nil
+		term.mu.RUnlock()
+		if waiting {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("start never began waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := term.Stop(ctx, false); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+
+	select {
+	case err := <-started:
+		if err == nil {
+			t.Error("interrupted start returned no error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("start still running after the stop")
+	}
+
+	if got := term.State(); got != StateStopped {
+		t.Errorf("terminal is %s, want stopped", got)
+	}
+}
+
+func TestStartOfflineTerminal(t *testing.T) {
+	tc, fake := newTestConnector(t)
+	ctx := context.Background()
+
+	term, err := tc.Register(TerminalDeploy{Id: "abc", Type: common.MT5, Login: 1001, Server: "Demo-1"})
+	if err != nil {
+		t.Fatalf("deploy: %v", err)
+	}
+
+	// like a terminal reloaded after a controller restart
+	term.setState(StateOnline)
+	term.setState(StateOffline)
+
+	connectWhenLaunched(t, term)
+	if err := term.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	assertRuntime(t, fake, term, StateOnline, RuntimeRunning, "prepare abc", "start abc", "start abc")
+}
+
+func TestLateConnectAfterFailedStart(t *testing.T) {
+	term := NewTerminal(context.Background(), "abc", common.MT5, 1001, "Demo-1", "", false, nil)
+	term.state = StateFailed
+
+	if !term.setState(StateOnline) {
+		t.Errorf("a failed terminal should accept its EA connecting late")
+	}
+}
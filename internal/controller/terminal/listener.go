@@ -0,0 +1,137 @@
+package terminal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Transport is one place terminals can connect to. The rest of the terminal code only sees net.Conn
+type Transport struct {
+	Network    string      // tcp or unix
+	Address    string      // host:port or socket path
+	Mode       os.FileMode // unix only, permissions of the socket file
+	TerminalId string      // unix only, set for per terminal sockets that only that terminal may use
+}
+
+func (t Transport) String() string {
+	if t.TerminalId != "" {
+		return fmt.Sprintf("%s:%s (terminal %s)", t.Network, t.Address, t.TerminalId)
+	}
+
+	return t.Network + ":" + t.Address
+}
+
+// EAAddress is what the EA is given to connect back, unix sockets are prefixed with unix:
+func (t Transport) EAAddress() string {
+	if t.Network == "unix" {
+		return "unix:" + t.Address
+	}
+
+	return t.Address
+}
+
+func (t Transport) listen() (net.Listener, error) {
+	switch t.Network {
+	case "tcp":
+		return net.Listen("tcp", t.Address)
+	case "unix":
+		if err := os.MkdirAll(filepath.Dir(t.Address), 0700); err != nil {
+			return nil, err
+		}
+
+		// a socket left over from a previous run would make the listen fail
+		if err := os.Remove(t.Address); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		listener, err := net.Listen("unix", t.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		mode := t.Mode
+		if mode == 0 {
+			mode = 0600
+		}
+
+		// file permissions are what keeps other users (and other terminals' pods) off the socket
+		if err := os.Chmod(t.Address, mode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+
+		return listener, nil
+	default:
+		return nil, fmt.Errorf("unknown transport network %s", t.Network)
+	}
+}
+
+// ParseTransport reads tcp://host:port, unix:///path/to.sock, unix:/path or a bare host:port (tcp)
+func ParseTransport(addr string) (Transport, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		return Transport{Network: "unix", Address: strings.TrimPrefix(addr, "unix://")}, nil
+	case strings.HasPrefix(addr, "unix:"):
+		return Transport{Network: "unix", Address: strings.TrimPrefix(addr, "unix:")}, nil
+	case strings.HasPrefix(addr, "tcp://"):
+		return Transport{Network: "tcp", Address: strings.TrimPrefix(addr, "tcp://")}, nil
+	case strings.Contains(addr, "://"):
+		return Transport{}, fmt.Errorf("unsupported transport %s", addr)
+	default:
+		return Transport{Network: "tcp", Address: addr}, nil
+	}
+}
+
+// serve starts accepting on the transport until the connector stops or the listener is closed
+func (tc *TerminalConnector) serve(transport Transport) (net.Listener, error) {
+	listener, err := transport.listen()
+	if err != nil {
+		return nil, fmt.Errorf("listen on %s failed: %v", transport, err)
+	}
+
+	log.Printf("[ctrl] terminal connector listening on: %s", transport)
+
+	go func() {
+		<-tc.ctx.Done()
+		listener.Close()
+	}()
+
+	go tc.acceptNewConnections(listener, transport)
+
+	return listener, nil
+}
+
+func (tc *TerminalConnector) acceptNewConnections(listener net.Listener, transport Transport) {
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			select {
+			case <-tc.ctx.Done():
+				return
+			default:
+				log.Printf("[ctrl] accept new terminal conn err on %s: %v", transport, err)
+				time.Sleep(200 * time.Millisecond)
+				continue
+			}
+		}
+
+		// pass this new connection on to the respective terminal
+		go tc.handleIncomingConnection(&conn, transport)
+	}
+}
+
+// terminalSocket is the per terminal socket, inside the terminal dir so it can be shared with its pod
+func terminalSocket(terminalDir string) string {
+	return filepath.Join(terminalDir, "controller.sock")
+}
@@ -0,0 +1,231 @@
+package terminal
+
+import (
+	"backend/internal/common"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPodmanBinary  = "podman"
+	defaultPodmanNetwork = "host"
+	podmanStopTimeout    = 10 * time.Second // how long podman waits after SIGTERM before killing the terminal
+	podmanCommandTimeout = 2 * time.Minute  // upper bound for a single podman call, create can pull the image
+	podmanLabel          = "traderkit.terminal"
+)
+
+// commandRunner runs an external command and returns its stdout. Podman goes through it so
+// CI can point the controller at a fake podman binary
+type commandRunner interface {
+	Run(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+type execRunner struct{}
+
+func (execRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, msg)
+		}
+		return nil, fmt.Errorf("%s %s: %v", name, strings.Join(args, " "), err)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// podmanClient is the podman TerminalRuntime, one container per terminal
+type podmanClient struct {
+	runner  commandRunner
+	binary  string
+	image   string
+	network string
+}
+
+func newPodmanClient(conf common.PodmanConfig, runner commandRunner) *podmanClient {
+	if runner == nil {
+		runner = execRunner{}
+	}
+
+	client := &podmanClient{
+		runner:  runner,
+		binary:  conf.Binary,
+		image:   conf.Image,
+		network: conf.Network,
+	}
+
+	if client.binary == "" {
+		client.binary = defaultPodmanBinary
+	}
+	if client.network == "" {
+		client.network = defaultPodmanNetwork
+	}
+
+	return client
+}
+
+func (p *podmanClient) run(args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), podmanCommandTimeout)
+	defer cancel()
+
+	out, err := p.runner.Run(ctx, p.binary, args...)
+	return strings.TrimSpace(string(out)), err
+}
+
+func containerName(terminalId string) string {
+	return "terminal-" + terminalId
+}
+
+func (p *podmanClient) Name() string {
+	return RuntimePodman
+}
+
+// Prepare creates the container without starting it. The terminal dir is mounted at the same path
+// so the config, the ea params and a per terminal socket mean the same thing on both sides
+func (p *podmanClient) Prepare(pod *PodmanDetails) error {
+	if p.image == "" {
+		return fmt.Errorf("no terminal image configured for podman")
+	}
+
+	// --replace drops a container left over from an earlier deploy of the same terminal
+	id, err := p.run("create",
+		"--replace",
+		"--name", containerName(pod.terminalId),
+		"--label", podmanLabel+"="+pod.terminalId,
+		"--network", p.network,
+		"--volume", pod.volumePath+":"+pod.volumePath+":Z",
+		"--workdir", pod.volumePath,
+		p.image,
+		pod.execPath, "/portable", pod.configPath,
+	)
+	if err != nil {
+		return err
+	}
+
+	pod.setContainer(id, RuntimeCreated)
+	return nil
+}
+
+func (p *podmanClient) Start(pod *PodmanDetails) error {
+	// a full stop removed the container, bring it back from the same dir
+	if id, _ := pod.container(); id == "" {
+		if err := p.Prepare(pod); err != nil {
+			return err
+		}
+	}
+
+	id, _ := pod.container()
+	log.Printf("[ctrl] starting terminal container %s", id)
+	if _, err := p.run("start", id); err != nil {
+		return err
+	}
+
+	return p.refresh(pod)
+}
+
+func (p *podmanClient) Stop(pod *PodmanDetails) error {
+	id, _ := pod.container()
+	if id == "" {
+		return nil
+	}
+
+	if _, err := p.run("stop", "--time", strconv.Itoa(int(podmanStopTimeout.Seconds())), id); err != nil {
+		return err
+	}
+
+	return p.refresh(pod)
+}
+
+func (p *podmanClient) Status(pod *PodmanDetails) (RuntimeStatus, error) {
+	if id, _ := pod.container(); id == "" {
+		return RuntimeRemoved, nil
+	}
+
+	if err := p.refresh(pod); err != nil {
+		return RuntimeUnknown, err
+	}
+
+	_, status := pod.container()
+	return RuntimeStatus(status), nil
+}
+
+func (p *podmanClient) Logs(pod *PodmanDetails, lines int) ([]byte, error) {
+	id, _ := pod.container()
+	if id == "" {
+		return nil, fmt.Errorf("terminal %s has no container", pod.terminalId)
+	}
+
+	args := []string{"logs"}
+	if lines > 0 {
+		args = append(args, "--tail", strconv.Itoa(lines))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), podmanCommandTimeout)
+	defer cancel()
+
+	return p.runner.Run(ctx, p.binary, append(args, id)...)
+}
+
+func (p *podmanClient) Destroy(pod *PodmanDetails) error {
+	id, _ := pod.container()
+	if id == "" {
+		return nil
+	}
+
+	if _, err := p.run("rm", "--force", id); err != nil {
+		return err
+	}
+
+	pod.setContainer("", RuntimeRemoved)
+	return nil
+}
+
+// refresh records the container status
+func (p *podmanClient) refresh(pod *PodmanDetails) error {
+	id, _ := pod.container()
+	out, err := p.run("inspect", "--format", "{{.State.Status}}", id)
+	if err != nil {
+		return err
+	}
+
+	pod.setContainer(id, containerStatus(out))
+	return nil
+}
+
+// containerStatus folds podman's exited/paused etc. into our statuses
+func containerStatus(inspected string) RuntimeStatus {
+	switch inspected {
+	case "created", "configured", "initialized":
+		return RuntimeCreated
+	case "running":
+		return RuntimeRunning
+	case "exited", "stopped", "paused", "stopping":
+		return RuntimeStopped
+	default:
+		return RuntimeUnknown
+	}
+}
+
+func (pod *PodmanDetails) container() (id string, status string) {
+	pod.mu.Lock()
+	defer pod.mu.Unlock()
+	return pod.podId, pod.status
+}
+
+func (pod *PodmanDetails) setContainer(id string, status RuntimeStatus) {
+	pod.mu.Lock()
+	defer pod.mu.Unlock()
+	pod.podId = id
+	pod.status = string(status)
+}
@@ -0,0 +1,224 @@
+package terminal
+
+import (
+	"backend/internal/common"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRunner answers podman commands by subcommand and records every call
+type fakeRunner struct {
+	mu      sync.Mutex
+	calls   []string
+	outputs map[string]string // subcommand -> stdout
+	errs    map[string]error  // subcommand -> error
+}
+
+func newFakeRunner() *fakeRunner {
+	return &fakeRunner{
+		outputs: map[string]string{"create": "c0ffee\n"},
+		errs:    make(map[string]error),
+	}
+}
+
+func (r *fakeRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls = append(r.calls, name+" "+strings.Join(args, " "))
+	if err := r.errs[args[0]]; err != nil {
+		return nil, err
+	}
+
+	return []byte(r.outputs[args[0]]), nil
+}
+
+func (r *fakeRunner) last() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.calls) == 0 {
+		return ""
+	}
+	return r.calls[len(r.calls)-1]
+}
+
+func newTestPodman(runner *fakeRunner) (*podmanClient, *PodmanDetails) {
+	client := newPodmanClient(common.PodmanConfig{Image: "traderkit/mt5:latest"}, runner)
+	pod := &PodmanDetails{
+		terminalId: "abc",
+		volumePath: "/terminals/abc",
+		configPath: "/terminals/abc/config.ini",
+		execPath:   "/terminals/abc/terminal64.exe",
+	}
+
+	return client, pod
+}
+
+func TestPodmanPrepare(t *testing.T) {
+	runner := newFakeRunner()
+	client, pod := newTestPodman(runner)
+
+	if err := client.Prepare(pod); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+
+	call := runner.last()
+	for _, want := range []string{
+		"podman create --replace --name terminal-abc",
+		"--label traderkit.terminal=abc",
+		"--network host",
+		"--volume /terminals/abc:/terminals/abc:Z",
+		"traderkit/mt5:latest /terminals/abc/terminal64.exe /portable /terminals/abc/config.ini",
+	} {
+		if !strings.Contains(call, want) {
+			t.Errorf("create call %q is missing %q", call, want)
+		}
+	}
+
+	if id, status := pod.container(); id != "c0ffee" || status != string(RuntimeCreated) {
+		t.Errorf("got container %q (%s), want c0ffee (created)", id, status)
+	}
+}
+
+func TestPodmanPrepareWithoutImage(t *testing.T) {
+	runner := newFakeRunner()
+	client, pod := newTestPodman(runner)
+	client.image = ""
+
+	if err := client.Prepare(pod); err == nil {
+		t.Fatal("expected an error without an image")
+	}
+	if len(runner.calls) != 0 {
+		t.Errorf("podman was called: %v", runner.calls)
+	}
+}
+
+func TestPodmanStartStopRemove(t *testing.T) {
+	runner := newFakeRunner()
+	client, pod := newTestPodman(runner)
+
+	// no container yet, start creates it first
+	runner.outputs["inspect"] = "running"
+	if err := client.Start(pod); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	want := []string{"create", "start c0ffee", "inspect --format {{.State.Status}} c0ffee"}
+	if len(runner.calls) != len(want) {
+		t.Fatalf("got calls %v, want %d", runner.calls, len(want))
+	}
+	for i, call := range runner.calls {
+		if !strings.HasPrefix(call, "podman "+want[i]) {
+			t.Errorf("call %d is %q, want podman %s", i, call, want[i])
+		}
+	}
+	if status, _ := client.Status(pod); status != RuntimeRunning {
+		t.Errorf("status after start is %s", status)
+	}
+
+	runner.outputs["inspect"] = "exited"
+	if err := client.Stop(pod); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if !strings.HasPrefix(runner.calls[len(runner.calls)-2], "podman stop --time 10 c0ffee") {
+		t.Errorf("unexpected stop call %q", runner.calls[len(runner.calls)-2])
+	}
+	if _, status := pod.container(); status != string(RuntimeStopped) {
+		t.Errorf("status after stop is %s", status)
+	}
+
+	if err := client.Destroy(pod); err != nil {
+		t.Fatalf("destroy: %v", err)
+	}
+	if call := runner.last(); call != "podman rm --force c0ffee" {
+		t.Errorf("unexpected remove call %q", call)
+	}
+	if status, _ := client.Status(pod); status != RuntimeRemoved {
+		t.Errorf("status after destroy is %s", status)
+	}
+
+	// nothing left to stop or remove
+	calls := len(runner.calls)
+	if err := client.Stop(pod); err != nil {
+		t.Fatalf("stop without container: %v", err)
+	}
+	if err := client.Destroy(pod); err != nil {
+		t.Fatalf("destroy without container: %v", err)
+	}
+	if len(runner.calls) != calls {
+		t.Errorf("podman was called without a container: %v", runner.calls[calls:])
+	}
+}
+
+func TestPodmanStartFailure(t *testing.T) {
+	runner := newFakeRunner()
+	client, pod := newTestPodman(runner)
+	runner.errs["start"] = errors.New("no such image")
+
+	if err := client.Start(pod); err == nil {
+		t.Fatal("expected the start error")
+	}
+	if call := runner.last(); call != "podman start c0ffee" {
+		t.Errorf("last call is %q, status should not be inspected after a failed start", call)
+	}
+}
+
+func TestPodmanLogs(t *testing.T) {
+	runner := newFakeRunner()
+	client, pod := newTestPodman(runner)
+
+	if _, err := client.Logs(pod, 10); err == nil {
+		t.Error("expected an error without a container")
+	}
+
+	pod.setContainer("c0ffee", RuntimeRunning)
+	runner.outputs["logs"] = "line\n"
+	out, err := client.Logs(pod, 10)
+	if err != nil {
+		t.Fatalf("logs: %v", err)
+	}
+	if string(out) != "line\n" || runner.last() != "podman logs --tail 10 c0ffee" {
+		t.Errorf("got %q from %q", out, runner.last())
+	}
+}
+
+func TestContainerStatus(t *testing.T) {
+	tests := map[string]RuntimeStatus{
+		"created":     RuntimeCreated,
+		"configured":  RuntimeCreated,
+		"initialized": RuntimeCreated,
+		"running":     RuntimeRunning,
+		"exited":      RuntimeStopped,
+		"stopped":     RuntimeStopped,
+		"paused":      RuntimeStopped,
+		"stopping":    RuntimeStopped,
+		"removing":    RuntimeUnknown,
+		"":            RuntimeUnknown,
+	}
+
+	for inspected, want := range tests {
+		if got := containerStatus(inspected); got != want {
+			t.Errorf("containerStatus(%q) = %s, want %s", inspected, got, want)
+		}
+	}
+}
+
+func TestPodmanRefreshTrimsInspectOutput(t *testing.T) {
+	runner := newFakeRunner()
+	client, pod := newTestPodman(runner)
+	pod.setContainer("c0ffee", RuntimeCreated)
+
+	runner.outputs["inspect"] = "paused\n"
+	if status, err := client.Status(pod); err != nil || status != RuntimeStopped {
+		t.Errorf("got %s, %v, want stopped", status, err)
+	}
+
+	runner.errs["inspect"] = errors.New("no such container")
+	if status, err := client.Status(pod); err == nil || status != RuntimeUnknown {
+		t.Errorf("got %s, %v, want unknown with an error", status, err)
+	}
+}
@@ -0,0 +1,123 @@
+package terminal
+
+import (
+	"backend/internal/common"
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrQueueFull = errors.New("terminal queue full")
+
+var defaultQueueConfig = common.TerminalQueueConfig{
+	Size:     256,
+	Overflow: common.OverflowReject,
+}
+
+// taskQueue holds the tasks waiting to be written to a terminal. It never blocks the sender,
+// a full queue either rejects the task or makes room by dropping the oldest data task
+type taskQueue struct {
+	mu       sync.Mutex
+	items    []common.TaskReq
+	size     int
+	overflow common.OverflowPolicy
+	ready    chan struct{} // signalled whenever items are added
+}
+
+func newTaskQueue(conf common.TerminalQueueConfig) *taskQueue {
+	if conf.Size <= 0 {
+		conf.Size = defaultQueueConfig.Size
+	}
+
+	if conf.Overflow == "" {
+		conf.Overflow = defaultQueueConfig.Overflow
+	}
+
+	return &taskQueue{
+		items:    make([]common.TaskReq, 0, conf.Size),
+		size:     conf.Size,
+		overflow: conf.Overflow,
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+// push queues the task. dropped is set when an older data request made room for it
+func (q *taskQueue) push(task common.TaskReq) (dropped *common.TaskReq, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) >= q.size {
+		if q.overflow != common.OverflowDropOldestData {
+			return nil, ErrQueueFull
+		}
+
+		// internal tasks (heartbeats) have no request id and nobody to tell about the drop
+		idx := -1
+		for i, item := range q.items {
+			if item.ReqType == common.DataTask && item.Id != 0 {
+				idx = i
+				break
+			}
+		}
+
+		// only trades and internal tasks queued, those are never dropped
+		if idx < 0 {
+			return nil, ErrQueueFull
+		}
+
+		old := q.items[idx]
+		q.items = append(q.items[:idx], q.items[idx+1:]...)
+		dropped = &old
+	}
+
+	q.items = append(q.items, task)
+	q.signal()
+
+	return dropped, nil
+}
+
+// pushFront puts back a task that could not be written so it goes out first on the next connection
+func (q *taskQueue) pushFront(task common.TaskReq) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.items = append([]common.TaskReq{task}, q.items...)
+	q.signal()
+}
+
+func (q *taskQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop waits for the next task, ok is false once ctx is done
+func (q *taskQueue) pop(ctx context.Context) (task common.TaskReq, ok bool) {
+	for {
+		q.mu.Lock()
+		if len(q.items) > 0 {
+			task = q.items[0]
+			q.items = q.items[1:]
+			if len(q.items) > 0 {
+				// keep the next waiter going
+				q.signal()
+			}
+			q.mu.Unlock()
+			return task, true
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return task, false
+		case <-q.ready:
+		}
+	}
+}
+
+func (q *taskQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
@@ -0,0 +1,42 @@
+package terminal
+
+import (
+	"backend/internal/common"
+	"errors"
+	"testing"
+)
+
+func TestQueueDropOldestDataKeepsInternalTasks(t *testing.T) {
+	q := newTaskQueue(common.TerminalQueueConfig{Size: 3, Overflow: common.OverflowDropOldestData})
+
+	heartbeat := common.TaskReq{ReqType: common.DataTask, ReqSubType: common.DataTaskHeartbeat}
+	for _, task := range []common.TaskReq{
+		heartbeat,
+		{Id: 1, ReqType: common.TradeTask, ReqSubType: common.TradeTaskAdd},
+		{Id: 2, ReqType: common.DataTask, ReqSubType: common.DataTaskPrice},
+	} {
+		if _, err := q.push(task); err != nil {
+			t.Fatalf("push %d: %v", task.Id, err)
+		}
+	}
+
+	dropped, err := q.push(common.TaskReq{Id: 3, ReqType: common.DataTask, ReqSubType: common.DataTaskSymbol})
+	if err != nil {
+		t.Fatalf("push 3: %v", err)
+	}
+	if dropped == nil || dropped.Id != 2 {
+		t.Fatalf("dropped %v, want data request 2", dropped)
+	}
+
+	// the heartbeat and the trade are all that's left apart from request 3
+	dropped, err = q.push(common.TaskReq{Id: 4, ReqType: common.DataTask, ReqSubType: common.DataTaskPrice})
+	if err != nil || dropped == nil || dropped.Id != 3 {
+		t.Fatalf("got %v, %v, want request 3 dropped", dropped, err)
+	}
+
+	q = newTaskQueue(common.TerminalQueueConfig{Size: 1, Overflow: common.OverflowDropOldestData})
+	q.push(heartbeat)
+	if _, err := q.push(common.TaskReq{Id: 5, ReqType: common.DataTask}); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("got %v, want ErrQueueFull instead of dropping the heartbeat", err)
+	}
+}
@@ -0,0 +1,331 @@
+package terminal
+
+import (
+	"backend/internal/common"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TerminalInfo is a snapshot of a registered terminal
+type TerminalInfo struct {
+	Id        string              `json:"id"`
+	Type      common.TerminalType `json:"type"`
+	Login     int                 `json:"login"`
+	Server    string              `json:"server"`
+	State     TerminalState       `json:"state"`
+	LastSeen  time.Time           `json:"last_seen"`
+	Queued    int                 `json:"queued"`
+	Runtime   string              `json:"runtime,omitempty"`
+	PodId     string              `json:"pod_id,omitempty"`
+	PodStatus string              `json:"pod_status,omitempty"`
+}
+
+func (term *Terminal) Info() TerminalInfo {
+	term.mu.RLock()
+	defer term.mu.RUnlock()
+
+	info := TerminalInfo{
+		Id:       term.Id,
+		Type:     term.Type,
+		Login:    term.login,
+		Server:   term.server,
+		State:    term.state,
+		LastSeen: term.lastSeen,
+		Queued:   term.queue.len(),
+	}
+
+	if term.pod != nil {
+		info.Runtime = term.pod.runtime.Name()
+		info.PodId, info.PodStatus = term.pod.container()
+	}
+
+	return info
+}
+
+func newTerminalId() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("[ctrl] failed to generate terminal id: %v", err)
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// Register adds a terminal for the deployment and deploys it, blocking until the files are in place
+// and the process is started. A failed deploy stays registered in the failed state so it can be retried
+func (tc *TerminalConnector) Register(details TerminalDeploy) (*Terminal, error) {
+	if details.Id == "" {
+		id, err := newTerminalId()
+		if err != nil {
+			return nil, err
+		}
+		details.Id = id
+	}
+
+	// a fresh secret on every deploy, so redeploying also rotates it
+	secret, err := generateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	tc.mu.Lock()
+	term, exists := tc.terminals[details.Id]
+	if exists {
+		// online or stopping terminals can't be redeployed under the same id
+		if !term.setState(StateDeploying) {
+			tc.mu.Unlock()
+			return nil, fmt.Errorf("[ctrl] terminal %s is already registered (%s)", details.Id, term.State())
+		}
+
+		// the redeploy may log into another account
+		term.mu.Lock()
+		tc.unindexAccountLocked(term.Id, term.login, term.server)
+		term.login = details.Login
+		term.server = details.Server
+		term.master = details.Master
+		term.mu.Unlock()
+		tc.indexAccountLocked(term.Id, details.Login, details.Server)
+	} else {
+		term = tc.addTerminalLocked(NewTerminal(tc.ctx, details.Id, details.Type, details.Login, details.Server, "", details.TradingAllowed, nil))
+		term.state = StateDeploying
+		term.master = details.Master
+	}
+	tc.mu.Unlock()
+
+	// set before deploying, the EA may connect before CreateTerminal returns
+	term.SetSecret(secret)
+
+	controllerAddr, err := tc.eaAddress(details.Id)
+	if err == nil {
+		err = tc.openTerminalSocket(details.Id)
+	}
+	if err != nil {
+		term.setState(StateFailed)
+		return term, fmt.Errorf("[ctrl] failed to deploy terminal %s: %v", details.Id, err)
+	}
+
+	runtime, err := tc.runtimeFor(details.Runtime)
+	if err != nil {
+		term.setState(StateFailed)
+		return term, err
+	}
+
+	tc.forgetCrashes(details.Id)
+	pod, err := CreateTerminal(details, controllerAddr, secret, runtime, tc.bases)
+	if err != nil {
+		term.setState(StateFailed)
+		return term, fmt.Errorf("[ctrl] failed to deploy terminal %s: %v", details.Id, err)
+	}
+
+	term.mu.Lock()
+	term.terminalPath = pod.volumePath
+	term.pod = pod
+	if term.state == StateDeploying {
+		term.setStateLocked(StateAwaitingConnect)
+	}
+	term.mu.Unlock()
+
+	log.Printf("[ctrl] deployed terminal %s for %d@%s", details.Id, details.Login, details.Server)
+	return term, nil
+}
+
+// addTerminalLocked wires a new terminal to the connector and registers it (caller holds tc.mu)
+func (tc *TerminalConnector) addTerminalLocked(term *Terminal) *Terminal {
+	term.queue = newTaskQueue(tc.queueConf)
+	term.UpdateResponseChan(tc.responses)
+	term.events = tc.events
+	term.restartBackoff = common.NewBackoff(common.BackoffConfig{
+		Initial: tc.watchdogConf.RestartAfter,
+		Max:     8 * tc.watchdogConf.RestartAfter,
+	})
+
+	tc.terminals[term.Id] = term
+	tc.indexAccountLocked(term.Id, term.login, term.server)
+	return term
+}
+
+// Reload registers the terminals deployed before a restart from their directories, so their EAs
+// can authenticate again and their unacked result files are resent and collected.
+// They come back offline, the watchdog restarts the ones that don't reconnect
+func (tc *TerminalConnector) Reload() error {
+	terminalsDir, err := terminalsRoot()
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(terminalsDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("[ctrl] failed to read terminals dir: %v", err)
+	}
+
+	runtime, err := tc.runtimeFor("")
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(terminalsDir, entry.Name())
+		term, err := tc.reloadTerminal(dir, runtime)
+		if err != nil {
+			log.Printf("[ctrl] skipping terminal dir %s: %v", dir, err)
+			continue
+		}
+		if term == nil {
+			continue
+		}
+
+		if err := tc.openTerminalSocket(term.Id); err != nil {
+			log.Printf("[ctrl] failed to open socket of terminal %s: %v", term.Id, err)
+		}
+
+		log.Printf("[ctrl] reloaded terminal %s for %d@%s", term.Id, term.login, term.server)
+	}
+
+	return nil
+}
+
+// reloadTerminal registers the terminal deployed in dir, nil when it is registered already
+func (tc *TerminalConnector) reloadTerminal(dir string, runtime TerminalRuntime) (*Terminal, error) {
+	id := filepath.Base(dir)
+	if _, ok := tc.Get(id); ok {
+		return nil, nil
+	}
+
+	termType, err := deployedType(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	pod := podDetailsFor(dir, termType)
+	pod.runtime = runtime
+
+	login, server, err := readAccount(pod.configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	term := NewTerminal(tc.ctx, id, termType, login, server, dir, false, nil)
+	if err := term.LoadSecret(); err != nil {
+		// registered anyway so it can be redeployed, which writes a new secret
+		log.Printf("[ctrl] terminal %s has no secret, it can't authenticate until redeployed: %v", id, err)
+	}
+	if master, _ := readEAParam(dir, termType, "CopyMaster"); master == "true" {
+		term.master = true
+	}
+	term.pod = pod
+	term.state = StateOffline
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if _, ok := tc.terminals[id]; ok {
+		return nil, nil
+	}
+
+	return tc.addTerminalLocked(term), nil
+}
+
+// deployedType tells mt4 and mt5 installs apart by their executable
+func deployedType(dir string) (common.TerminalType, error) {
+	if _, err := os.Stat(filepath.Join(dir, "terminal64.exe")); err == nil {
+		return common.MT5, nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, "terminal.exe")); err == nil {
+		return common.MT4, nil
+	}
+
+	return "", fmt.Errorf("no terminal executable")
+}
+
+// readAccount reads the login and server back from the terminal config written on deploy
+func readAccount(configPath string) (login int, server string, err error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return 0, "", err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "Login":
+			if login, err = strconv.Atoi(value); err != nil {
+				return 0, "", fmt.Errorf("bad login %q in %s", value, configPath)
+			}
+		case "Server":
+			server = value
+		}
+	}
+
+	if login == 0 || server == "" {
+		return 0, "", fmt.Errorf("no account in %s", configPath)
+	}
+
+	return login, server, nil
+}
+
+// Unregister drops the terminal and its connection, the files on disk are left alone
+func (tc *TerminalConnector) Unregister(id string) error {
+	tc.mu.Lock()
+	term, ok := tc.terminals[id]
+	if ok {
+		delete(tc.terminals, id)
+
+		term.mu.RLock()
+		tc.unindexAccountLocked(id, term.login, term.server)
+		term.mu.RUnlock()
+	}
+	tc.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("[ctrl] terminal %s not found", id)
+	}
+
+	tc.closeTerminalSocket(id)
+	term.Shutdown()
+	return nil
+}
+
+// List returns a snapshot of every registered terminal ordered by id
+func (tc *TerminalConnector) List() []TerminalInfo {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+
+	list := make([]TerminalInfo, 0, len(tc.terminals))
+	for _, term := range tc.terminals {
+		list = append(list, term.Info())
+	}
+
+	slices.SortFunc(list, func(a, b TerminalInfo) int {
+		return strings.Compare(a.Id, b.Id)
+	})
+
+	return list
+}
+
+func (tc *TerminalConnector) Get(id string) (terminal *Terminal, ok bool) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+
+	terminal, ok = tc.terminals[id]
+	return
+}
@@ -0,0 +1,286 @@
+package terminal
+
+import (
+	"backend/internal/common"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the EA writes every result to <terminal>/MQL{4,5}/Files/responses/<request id>.json before sending it,
+// the file stays until the server acked the result so nothing is lost across restarts
+func responsesDir(terminalDir string, termType common.TerminalType) string {
+	if termType == common.MT4 {
+		return filepath.Join(terminalDir, "MQL4", "Files", "responses")
+	}
+
+	return filepath.Join(terminalDir, "MQL5", "Files", "responses")
+}
+
+func responseFileName(reqId int) string {
+	return strconv.Itoa(reqId) + ".json"
+}
+
+// responseFiles tracks which result files of a terminal were already sent by this process
+type responseFiles struct {
+	mu   sync.Mutex
+	sent map[int]struct{}
+}
+
+func newResponseFiles() *responseFiles {
+	return &responseFiles{sent: make(map[int]struct{})}
+}
+
+// markSent keeps the result file out of the next resend, the live result is on its way
+func (rf *responseFiles) markSent(reqId int) {
+	if reqId == 0 {
+		return
+	}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.sent[reqId] = struct{}{}
+}
+
+// release hands a result back when it could not be pushed, the next resend picks it up
+func (rf *responseFiles) release(reqId int) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	delete(rf.sent, reqId)
+}
+
+// unsent reads the result files in dir that haven't been sent yet, oldest first
+func (rf *responseFiles) unsent(dir string) ([]common.TaskRes, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	type stored struct {
+		res     common.TaskRes
+		modTime time.Time
+	}
+
+	found := make([]stored, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		reqId, err := strconv.Atoi(strings.TrimSuffix(name, ".json"))
+		if err != nil || reqId == 0 {
+			continue
+		}
+
+		if _, ok := rf.sent[reqId]; ok {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			log.Printf("[ctrl] failed to read response file %s: %v", name, err)
+			continue
+		}
+
+		var res common.TaskRes
+		if err := json.Unmarshal(data, &res); err != nil {
+			// the EA may still be writing it, picked up on the next pass
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		res.ReqId = reqId
+		found = append(found, stored{res: res, modTime: info.ModTime()})
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].modTime.Before(found[j].modTime) })
+
+	results := make([]common.TaskRes, 0, len(found))
+	for _, item := range found {
+		rf.sent[item.res.ReqId] = struct{}{}
+		results = append(results, item.res)
+	}
+
+	return results, nil
+}
+
+// ack deletes the result file once the server has it, ok is false when this terminal has no such file
+func (rf *responseFiles) ack(dir string, reqId int) (ok bool, err error) {
+	rf.mu.Lock()
+	delete(rf.sent, reqId)
+	rf.mu.Unlock()
+
+	if err := os.Remove(filepath.Join(dir, responseFileName(reqId))); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// gc removes result files older than ttl, the server never acked them and won't anymore
+func (rf *responseFiles) gc(dir string, ttl time.Duration) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+
+	cutoff := time.Now().Add(-ttl)
+	removed := 0
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			continue
+		}
+
+		if reqId, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".json")); err == nil {
+			rf.mu.Lock()
+			delete(rf.sent, reqId)
+			rf.mu.Unlock()
+		}
+		removed++
+	}
+
+	return removed
+}
+
+func (term *Terminal) responsesDir() string {
+	term.mu.RLock()
+	defer term.mu.RUnlock()
+
+	if term.terminalPath == "" {
+		return ""
+	}
+
+	return responsesDir(term.terminalPath, term.Type)
+}
+
+// resendStoredResponses sends the results the EA stored but we never sent, run after every (re)connect
+func (term *Terminal) resendStoredResponses(ctx context.Context) {
+	dir := term.responsesDir()
+	if dir == "" {
+		return
+	}
+
+	results, err := term.files.unsent(dir)
+	if err != nil {
+		log.Printf("[ctrl] failed to read stored responses of terminal %s: %v", term.Id, err)
+		return
+	}
+
+	if len(results) > 0 {
+		log.Printf("[ctrl] resending %d stored responses from terminal %s", len(results), term.Id)
+	}
+
+	term.mu.RLock()
+	responses := term.taskResponse
+	term.mu.RUnlock()
+
+	for i, res := range results {
+		// same as the live read path, otherwise the entry expires and fails a task that has its result
+		if forward, _ := term.inflight.resolve(res); !forward {
+			continue
+		}
+
+		term.stamp(&res)
+
+		select {
+		case <-ctx.Done():
+			for _, left := range results[i:] {
+				term.files.release(left.ReqId)
+			}
+			return
+		case responses <- res:
+		}
+	}
+}
+
+// AckResponse deletes the stored result file of the request once the server acked it
+func (tc *TerminalConnector) AckResponse(reqId int) {
+	tc.mu.RLock()
+	terminals := make([]*Terminal, 0, len(tc.terminals))
+	for _, term := range tc.terminals {
+		terminals = append(terminals, term)
+	}
+	tc.mu.RUnlock()
+
+	for _, term := range terminals {
+		dir := term.responsesDir()
+		if dir == "" {
+			continue
+		}
+
+		ok, err := term.files.ack(dir, reqId)
+		if err != nil {
+			log.Printf("[ctrl] failed to delete response file %d of terminal %s: %v", reqId, term.Id, err)
+		}
+		if ok {
+			return
+		}
+	}
+}
+
+// collectStaleResponses periodically removes result files the server never acked
+func (tc *TerminalConnector) collectStaleResponses(ctx context.Context) {
+	if tc.responseTTL <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(min(tc.responseTTL, time.Hour))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			tc.mu.RLock()
+			terminals := make([]*Terminal, 0, len(tc.terminals))
+			for _, term := range tc.terminals {
+				terminals = append(terminals, term)
+			}
+			tc.mu.RUnlock()
+
+			for _, term := range terminals {
+				dir := term.responsesDir()
+				if dir == "" {
+					continue
+				}
+
+				if removed := term.files.gc(dir, tc.responseTTL); removed > 0 {
+					log.Printf("[ctrl] removed %d stale response files of terminal %s", removed, term.Id)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package terminal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// runtime names, used in the controller config and in TerminalDeploy.Runtime
+const (
+	RuntimeRaw    = "raw"
+	RuntimePodman = "podman"
+	RuntimeFake   = "fake"
+)
+
+// RuntimeStatus is the state of the terminal process as its runtime sees it
+type RuntimeStatus string
+
+const (
+	RuntimeCreated RuntimeStatus = "created" // prepared, never started
+	RuntimeRunning RuntimeStatus = "running"
+	RuntimeStopped RuntimeStatus = "stopped"
+	RuntimeRemoved RuntimeStatus = "removed"
+	RuntimeUnknown RuntimeStatus = "unknown"
+)
+
+var ErrNoLogs = errors.New("no logs for this terminal")
+
+// TerminalRuntime runs terminal processes. The terminal files are in place before Prepare,
+// everything after that (process, container) belongs to the runtime
+type TerminalRuntime interface {
+	Name() string
+	Prepare(pod *PodmanDetails) error // set up whatever Start needs, without starting
+	Start(pod *PodmanDetails) error
+	Stop(pod *PodmanDetails) error // halt the terminal, Start can bring it back
+	Status(pod *PodmanDetails) (RuntimeStatus, error)
+	Logs(pod *PodmanDetails, lines int) ([]byte, error) // last lines of terminal output, 0 for everything
+	Destroy(pod *PodmanDetails) error                   // remove what Prepare set up, the terminal files stay
+}
+
+// RegisterRuntime makes a runtime available to deployments by name, replacing any runtime with that name
+func (tc *TerminalConnector) RegisterRuntime(runtime TerminalRuntime) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.runtimes[runtime.Name()] = runtime
+}
+
+// runtimeFor picks the runtime a deployment asked for, or the controller default
+func (tc *TerminalConnector) runtimeFor(name string) (TerminalRuntime, error) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+
+	if name == "" {
+		name = tc.defaultRuntime
+	}
+
+	runtime, ok := tc.runtimes[name]
+	if !ok {
+		return nil, fmt.Errorf("[ctrl] unknown terminal runtime %s", name)
+	}
+
+	return runtime, nil
+}
+
+// rawRuntime runs the terminal executable directly on the controller host, under the supervisor
+type rawRuntime struct {
+	supervisor *supervisor
+}
+
+func (r *rawRuntime) Name() string {
+	return RuntimeRaw
+}
+
+func (r *rawRuntime) Prepare(pod *PodmanDetails) error {
+	return nil
+}
+
+func (r *rawRuntime) Start(pod *PodmanDetails) error {
+	return r.supervisor.start(pod)
+}
+
+func (r *rawRuntime) Stop(pod *PodmanDetails) error {
+	return r.supervisor.stop(pod)
+}
+
+func (r *rawRuntime) Status(pod *PodmanDetails) (RuntimeStatus, error) {
+	return r.supervisor.status(pod), nil
+}
+
+func (r *rawRuntime) Logs(pod *PodmanDetails, lines int) ([]byte, error) {
+	out, err := os.ReadFile(terminalLogPath(pod))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoLogs
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return tailLines(out, lines), nil
+}
+
+func (r *rawRuntime) Destroy(pod *PodmanDetails) error {
+	return nil
+}
+
+// tailLines returns the last n lines of out, all of it for n <= 0
+func tailLines(out []byte, n int) []byte {
+	if n <= 0 {
+		return append([]byte(nil), out...)
+	}
+
+	end := len(out)
+	if end > 0 && out[end-1] == '\n' {
+		end--
+	}
+
+	start := end
+	for count := 0; start > 0; start-- {
+		if out[start-1] == '\n' {
+			count++
+			if count == n {
+				break
+			}
+		}
+	}
+
+	return append([]byte(nil), out[start:]...)
+}
@@ -0,0 +1,130 @@
+package terminal
+
+import (
+	"backend/internal/common"
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// TerminalState is where a terminal is in its lifecycle, from deployment to removal
+type TerminalState int
+
+const (
+	StateDeploying       TerminalState = iota // files and process are being set up
+	StateAwaitingConnect                      // deployed, waiting for the EA to connect back
+	StateOnline                               // EA connected and authenticated
+	StateOffline                              // EA connection dropped, waiting for a reconnect
+	StateStopping                             // being stopped or removed
+	StateFailed                               // deployment or startup failed
+	StateStopped                              // process halted on purpose, Start brings it back
+	StateStarting                             // process is being launched
+)
+
+func (s TerminalState) String() string {
+	switch s {
+	case StateDeploying:
+		return "deploying"
+	case StateAwaitingConnect:
+		return "awaiting-connect"
+	case StateOnline:
+		return "online"
+	case StateOffline:
+		return "offline"
+	case StateStopping:
+		return "stopping"
+	case StateFailed:
+		return "failed"
+	case StateStopped:
+		return "stopped"
+	case StateStarting:
+		return "starting"
+	default:
+		return "unknown"
+	}
+}
+
+func (s TerminalState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// the EA can connect before the deploy call returns, so deploying may go straight to online.
+// A failed terminal may still come online, an EA connecting late after a failed start proves it runs.
+// Offline terminals can be started, e.g. ones reloaded after a controller restart
+var terminalTransitions = map[TerminalState][]TerminalState{
+	StateDeploying:       {StateAwaitingConnect, StateOnline, StateFailed, StateStopping},
+	StateAwaitingConnect: {StateOnline, StateFailed, StateStopping, StateDeploying},
+	StateOnline:          {StateOffline, StateStopping},
+	StateOffline:         {StateOnline, StateStopping, StateFailed, StateDeploying, StateStarting},
+	StateStopping:        {StateStopped, StateFailed},
+	StateFailed:          {StateDeploying, StateStopping, StateStarting, StateOnline},
+	StateStopped:         {StateStarting, StateDeploying, StateStopping},
+	StateStarting:        {StateAwaitingConnect, StateOnline, StateFailed, StateStopping},
+}
+
+func (term *Terminal) State() TerminalState {
+	term.mu.RLock()
+	defer term.mu.RUnlock()
+	return term.state
+}
+
+// waitForState blocks until the terminal reaches want, the timeout passes or ctx is done
+func (term *Terminal) waitForState(ctx context.Context, want TerminalState, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		term.mu.RLock()
+		state, changed := term.state, term.stateChanged
+		term.mu.RUnlock()
+
+		if state == want {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return fmt.Errorf("[ctrl] terminal %s still %s after %s", term.Id, state, timeout)
+		case <-changed:
+		}
+	}
+}
+
+func (term *Terminal) setState(next TerminalState) bool {
+	term.mu.Lock()
+	defer term.mu.Unlock()
+	return term.setStateLocked(next)
+}
+
+// setStateLocked expects term.mu to be held, invalid transitions are logged and ignored
+func (term *Terminal) setStateLocked(next TerminalState) bool {
+	if term.state == next {
+		return true
+	}
+
+	for _, state := range terminalTransitions[term.state] {
+		if state == next {
+			term.state = next
+			term.stateSince = time.Now()
+
+			// wake up everyone waiting on a state change
+			close(term.stateChanged)
+			term.stateChanged = make(chan struct{})
+
+			switch next {
+			case StateOnline:
+				term.emitLocked(common.EventOnline, "")
+			case StateOffline:
+				term.emitLocked(common.EventOffline, "")
+			}
+
+			return true
+		}
+	}
+
+	log.Printf("[ctrl] terminal %s: ignoring invalid state change %s -> %s", term.Id, term.state, next)
+	return false
+}
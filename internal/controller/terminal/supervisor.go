@@ -0,0 +1,339 @@
+package terminal
+
+import (
+	"backend/internal/common"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var DefaultSupervisor = common.SupervisorConfig{
+	Backoff:     common.BackoffConfig{Initial: 5 * time.Second, Max: 5 * time.Minute},
+	MaxCrashes:  5,
+	StableAfter: 5 * time.Minute,
+	MaxLogSize:  10 << 20,
+}
+
+const supervisorStopTimeout = 10 * time.Second
+
+// processExit is what the supervisor reports every time a terminal process ends
+type processExit struct {
+	terminalId string
+	pid        int
+	exitCode   int // -1 when killed by a signal or never started
+	err        error
+	uptime     time.Duration
+	expected   bool          // the exit was asked for through stop
+	restartIn  time.Duration // set when the supervisor relaunches the crashed process
+	gaveUp     bool          // crashed too often in a row, left stopped
+	crashes    int           // crashes in a row so far, this one included
+}
+
+func (e processExit) String() string {
+	var msg string
+	if e.pid == 0 {
+		msg = fmt.Sprintf("failed to launch: %v", e.err)
+	} else {
+		msg = fmt.Sprintf("pid %d exited with code %d after %s", e.pid, e.exitCode, e.uptime.Round(time.Second))
+	}
+
+	switch {
+	case e.expected:
+		msg += " (stopped)"
+	case e.gaveUp:
+		msg += ", crash loop - not restarting"
+	case e.restartIn > 0:
+		msg += fmt.Sprintf(", restarting in %s", e.restartIn.Round(time.Millisecond))
+	}
+
+	return msg
+}
+
+// supervisedProcess is one terminal's process, kept across crash restarts
+type supervisedProcess struct {
+	pod      *PodmanDetails
+	cmd      *exec.Cmd // nil while waiting for a restart
+	started  time.Time
+	done     chan struct{} // closed when the current process has exited
+	stopping bool
+	crashes  int // in a row, reset once a run lasts StableAfter or by forget
+	backoff  *common.Backoff
+	restart  *time.Timer
+}
+
+// supervisor owns the raw terminal processes. It waits on every process, writes its output to
+// the terminal's log file and relaunches crashed terminals until they crash loop
+type supervisor struct {
+	mu      sync.Mutex
+	conf    common.SupervisorConfig
+	procs   map[string]*supervisedProcess // by terminal id
+	crashes map[string]int                // crashes in a row by terminal id, kept across stop and start
+	onExit  func(exit processExit)
+}
+
+func newSupervisor(conf common.SupervisorConfig, onExit func(exit processExit)) *supervisor {
+	if conf.MaxCrashes <= 0 {
+		conf.MaxCrashes = DefaultSupervisor.MaxCrashes
+	}
+	if conf.StableAfter <= 0 {
+		conf.StableAfter = DefaultSupervisor.StableAfter
+	}
+	if conf.MaxLogSize <= 0 {
+		conf.MaxLogSize = DefaultSupervisor.MaxLogSize
+	}
+	if conf.Backoff.Initial <= 0 {
+		conf.Backoff = DefaultSupervisor.Backoff
+	}
+
+	return &supervisor{
+		conf:    conf,
+		procs:   make(map[string]*supervisedProcess),
+		crashes: make(map[string]int),
+		onExit:  onExit,
+	}
+}
+
+// terminalLogPath is where a raw terminal's stdout and stderr go
+func terminalLogPath(pod *PodmanDetails) string {
+	return filepath.Join(pod.volumePath, "logs", "terminal.log")
+}
+
+// start launches the terminal. Earlier crashes still count so watchdog restarts can't get a
+// crash loop around MaxCrashes, only forget clears them
+func (s *supervisor) start(pod *PodmanDetails) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if proc, ok := s.procs[pod.terminalId]; ok {
+		if proc.cmd != nil {
+			return nil
+		}
+		if proc.restart != nil {
+			proc.restart.Stop()
+		}
+	}
+
+	proc := &supervisedProcess{
+		pod:     pod,
+		crashes: s.crashes[pod.terminalId],
+		backoff: common.NewBackoff(s.conf.Backoff),
+	}
+
+	if err := s.launchLocked(proc); err != nil {
+		return err
+	}
+
+	s.procs[pod.terminalId] = proc
+	return nil
+}
+
+func (s *supervisor) launchLocked(proc *supervisedProcess) error {
+	pod := proc.pod
+	if _, err := os.Stat(pod.execPath); os.IsNotExist(err) {
+		return fmt.Errorf("executable not found: %s", pod.execPath)
+	}
+
+	logFile, err := s.openLog(pod)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(pod.execPath, "/portable", pod.configPath)
+	cmd.Dir = filepath.Dir(pod.execPath)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+
+	fmt.Fprintf(logFile, "=== starting %s at %s ===\n", pod.execPath, time.Now().Format(time.RFC3339))
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(logFile, "=== failed to start: %v ===\n", err)
+		logFile.Close()
+		return err
+	}
+
+	proc.cmd = cmd
+	proc.started = time.Now()
+	proc.done = make(chan struct{})
+
+	log.Printf("[ctrl] launched terminal %s (pid %d)", pod.terminalId, cmd.Process.Pid)
+
+	go s.wait(proc, cmd, logFile)
+	return nil
+}
+
+// openLog appends to the terminal log, a log over MaxLogSize is rotated to terminal.log.1 first
+func (s *supervisor) openLog(pod *PodmanDetails) (*os.File, error) {
+	path := terminalLogPath(pod)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Size() > s.conf.MaxLogSize {
+		if err := os.Rename(path, path+".1"); err != nil {
+			log.Printf("[ctrl] failed to rotate %s: %v", path, err)
+		}
+	}
+
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
+
+func (s *supervisor) wait(proc *supervisedProcess, cmd *exec.Cmd, logFile *os.File) {
+	err := cmd.Wait()
+
+	exit := processExit{
+		terminalId: proc.pod.terminalId,
+		pid:        cmd.Process.Pid,
+		exitCode:   cmd.ProcessState.ExitCode(),
+		uptime:     time.Since(proc.started),
+	}
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		exit.err = err
+	}
+
+	s.mu.Lock()
+	proc.cmd = nil
+	close(proc.done)
+
+	if proc.stopping {
+		exit.expected = true
+	} else {
+		s.crashedLocked(proc, &exit)
+	}
+	s.mu.Unlock()
+
+	fmt.Fprintf(logFile, "=== %s ===\n", exit)
+	logFile.Close()
+
+	log.Printf("[ctrl] terminal %s: %s", exit.terminalId, exit)
+	s.onExit(exit)
+}
+
+// crashedLocked counts the crash and schedules a relaunch, or gives up on a crash loop
+func (s *supervisor) crashedLocked(proc *supervisedProcess, exit *processExit) {
+	if exit.uptime >= s.conf.StableAfter {
+		proc.crashes = 0
+		proc.backoff.Reset()
+	}
+
+	proc.crashes++
+	s.crashes[exit.terminalId] = proc.crashes
+	exit.crashes = proc.crashes
+	if proc.crashes > s.conf.MaxCrashes {
+		exit.gaveUp = true
+		if s.procs[exit.terminalId] == proc {
+			delete(s.procs, exit.terminalId)
+		}
+		return
+	}
+
+	exit.restartIn = proc.backoff.Next()
+	proc.restart = time.AfterFunc(exit.restartIn, func() {
+		s.relaunch(proc)
+	})
+}
+
+func (s *supervisor) relaunch(proc *supervisedProcess) {
+	s.mu.Lock()
+
+	// stopped or replaced by a manual start while we waited
+	if proc.stopping || s.procs[proc.pod.terminalId] != proc {
+		s.mu.Unlock()
+		return
+	}
+
+	err := s.launchLocked(proc)
+	if err == nil {
+		s.mu.Unlock()
+		return
+	}
+
+	exit := processExit{terminalId: proc.pod.terminalId, exitCode: -1, err: err}
+	s.crashedLocked(proc, &exit)
+	s.mu.Unlock()
+
+	log.Printf("[ctrl] terminal %s: %s", exit.terminalId, exit)
+	s.onExit(exit)
+}
+
+// forget clears the crash history of the terminal, for starts asked for by a user or a deploy
+func (s *supervisor) forget(terminalId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.crashes, terminalId)
+}
+
+// stop interrupts the terminal and waits for it, killing it when it doesn't exit in time
+func (s *supervisor) stop(pod *PodmanDetails) error {
+	s.mu.Lock()
+	proc, ok := s.procs[pod.terminalId]
+	if !ok {
+		s.mu.Unlock()
+		return nil
+	}
+
+	delete(s.procs, pod.terminalId)
+	proc.stopping = true
+	if proc.restart != nil {
+		proc.restart.Stop()
+	}
+
+	cmd, done := proc.cmd, proc.done
+	s.mu.Unlock()
+
+	if cmd == nil {
+		return nil
+	}
+
+	// ask nicely first so the terminal can save its state
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		cmd.Process.Kill()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(supervisorStopTimeout):
+	}
+
+	if err := cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+
+	<-done
+	return nil
+}
+
+func (s *supervisor) status(pod *PodmanDetails) RuntimeStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	proc, ok := s.procs[pod.terminalId]
+	if !ok || proc.cmd == nil {
+		return RuntimeStopped
+	}
+
+	return RuntimeRunning
+}
+
+// processExited turns a supervisor report into terminal events, a crash loop fails the terminal
+func (tc *TerminalConnector) processExited(exit processExit) {
+	term, ok := tc.Get(exit.terminalId)
+	if !ok {
+		return
+	}
+
+	term.emit(common.EventExit, exit.String())
+
+	if exit.gaveUp {
+		// the EA went with the process, don't wait for the reader to notice
+		term.dropConnection()
+		term.setState(StateFailed)
+		term.emit(common.EventGaveUp, fmt.Sprintf("crashed %d times in a row", exit.crashes))
+	}
+}
@@ -3,15 +3,14 @@ package terminal
 import (
 	"backend/internal/common"
 	"backend/internal/common/config"
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -20,11 +19,15 @@ import (
 )
 
 type PodmanDetails struct {
+	terminalId string
 	volumePath string
 	configPath string
 	execPath   string
+	mu         sync.Mutex // guards podId and status, the runtime updates them while Info reads them
 	podId      string
+	status     string // last container status podman reported
 	createdAt  time.Time
+	runtime    TerminalRuntime // runs the terminal, raw process or podman container
 }
 
 type Terminal struct {
@@ -37,14 +40,31 @@ type Terminal struct {
 	lastSeen       time.Time
 	terminalPath   string
 	tradingAllowed bool
+	master         bool // copy master, its results jump the queue on the way to the server
 	pod            *PodmanDetails
-
-	taskRequests chan common.TaskReq
+	secret         string // shared with the EA through its .set file, proves the connection is really this terminal
+	state          TerminalState
+	stateSince     time.Time
+	stateChanged   chan struct{}      // closed on every state change
+	opMu           sync.Mutex         // one Start/Stop/Restart at a time
+	startCancel    context.CancelFunc // ends the wait of a running Start, so Stop doesn't queue behind it
+	unloaded       chan struct{}      // the EA confirmed an unload
+	events         chan<- common.TerminalEvent
+
+	// watchdog restarts while the terminal stays offline
+	restarts       int
+	nextRestart    time.Time
+	restartBackoff *common.Backoff
+
+	queue    *taskQueue       // tasks waiting to be written to the EA, kept across reconnects
+	inflight *inflightTracker // sent tasks waiting on a result, retried per subtype policy
+	files    *responseFiles   // result files the EA stored, deleted once the server acks them
 
 	// always update this
 	taskResponse chan common.TaskRes
-	ctx          context.Context
+	ctx          context.Context // lives until the terminal is unregistered
 	cancel       context.CancelFunc
+	connCancel   context.CancelFunc // tears down the current EA connection
 }
 
 type TerminalDeploy struct {
@@ -56,10 +76,16 @@ type TerminalDeploy struct {
 	Server         string              `json:"server"`
 	ServerFile     string              `json:"server_file"`
 	TradingAllowed bool                `json:"trading_allowed"`
+	Runtime        string              `json:"runtime,omitempty"` // raw, podman or fake, empty uses the controller default
+	Master         bool                `json:"master,omitempty"`  // copy master, also set from the task by the handler
 }
 
 func NewTerminal(parentCtx context.Context, id string, termType common.TerminalType, login int, server string, terminalPath string, tradingAllowed bool, conn *net.Conn) *Terminal {
-	return &Terminal{
+	if parentCtx == nil {
+		parentCtx = context.Background()
+	}
+
+	term := &Terminal{
 		Id:             id,
 		Type:           termType,
 		login:          login,
@@ -68,44 +94,88 @@ func NewTerminal(parentCtx context.Context, id string, termType common.TerminalT
 		terminalPath:   terminalPath,
 		tradingAllowed: tradingAllowed,
 		lastSeen:       time.Now(),
-		taskRequests:   make(chan common.TaskReq),
+		queue:          newTaskQueue(defaultQueueConfig),
+		inflight:       newInflightTracker(DefaultTaskPolicies),
+		files:          newResponseFiles(),
+		state:          StateAwaitingConnect,
+		stateSince:     time.Now(),
+		stateChanged:   make(chan struct{}),
+		unloaded:       make(chan struct{}, 1),
+		restartBackoff: common.NewBackoff(common.BackoffConfig{Initial: DefaultWatchdog.RestartAfter}),
 	}
+	term.ctx, term.cancel = context.WithCancel(parentCtx)
+
+	// the secret comes from SetSecret on deploy or LoadSecret when Reload finds the terminal on disk
+	return term
 }
 
 // remember to clear the directories if a failure occurs
-func setupAndStartPodmanContainer(details TerminalDeploy) (*PodmanDetails, error) {
-	homeDir, err := os.UserHomeDir()
+func setupAndStartPodmanContainer(details TerminalDeploy, controllerAddr string, secret string, runtime TerminalRuntime, bases *baseStore) (*PodmanDetails, error) {
+	terminalDir, err := terminalDirFor(details.Id)
 	if err != nil {
 		return nil, err
 	}
 
-	terminalDir := filepath.Join(homeDir, "terminals", details.Id)
-
-	// TODO -> copy files to the created directory from our default directories
-
 	if err := os.MkdirAll(terminalDir, os.ModePerm); err != nil {
 		return nil, fmt.Errorf("[ctrl] failed to create terminal directories: %v", err)
 	}
 
-	configPath := filepath.Join(terminalDir, "config.ini")
-	execPath := filepath.Join(terminalDir, "terminal64.exe")
-	if details.Type == common.MT4 {
-		execPath = filepath.Join(terminalDir, "terminal.exe")
+	if err := bases.clone(details.Type, terminalDir); err != nil {
+		return nil, fmt.Errorf("[ctrl] failed to copy the %s base install: %v", details.Type, err)
 	}
 
+	pod := podDetailsFor(terminalDir, details.Type)
+	configPath := pod.configPath
+
 	if err := replaceConfigDetails(configPath, details.Login, details.Password, details.Server, details.Type); err != nil {
 		return nil, err
 	}
 
-	// create the pod container
-	// use the podman create command to only create and link volumes but do not start
+	if err := writeEAParams(terminalDir, details, controllerAddr, secret); err != nil {
+		return nil, err
+	}
+
+	// e.g. create the container and link the volume, starting is up to runTerminal
+	pod.runtime = runtime
+	if err := runtime.Prepare(pod); err != nil {
+		return nil, fmt.Errorf("[ctrl] failed to prepare %s terminal: %v", runtime.Name(), err)
+	}
+
+	return pod, nil
+}
+
+func podDetailsFor(terminalDir string, termType common.TerminalType) *PodmanDetails {
+	execPath := filepath.Join(terminalDir, "terminal64.exe")
+	if termType == common.MT4 {
+		execPath = filepath.Join(terminalDir, "terminal.exe")
+	}
 
 	return &PodmanDetails{
+		terminalId: filepath.Base(terminalDir),
 		volumePath: terminalDir,
-		configPath: configPath,
+		configPath: filepath.Join(terminalDir, "config.ini"),
 		execPath:   execPath,
 		createdAt:  time.Now(), // if we don't have any lastSeen greater than this, we need to delete this pod or at least recreate it -> cleanup task basically
-	}, nil
+	}
+}
+
+// terminalsRoot holds one directory per deployed terminal, named by terminal id
+func terminalsRoot() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(homeDir, "terminals"), nil
+}
+
+func terminalDirFor(id string) (string, error) {
+	root, err := terminalsRoot()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(root, id), nil
 }
 
 func replaceConfigDetails(config_path string, login int, password string, server string, term_type common.TerminalType) error {
@@ -137,7 +207,9 @@ func replaceConfigDetails(config_path string, login int, password string, server
 	return nil
 }
 
-func CreateTerminal(details TerminalDeploy) error {
+// CreateTerminal deploys the terminal files and starts it.
+// The secret is what the EA has to prove it knows when it connects back to controllerAddr
+func CreateTerminal(details TerminalDeploy, controllerAddr string, secret string, runtime TerminalRuntime, bases *baseStore) (*PodmanDetails, error) {
 	// get login details from the user
 	// get server file if present
 	if details.ServerFile == "" {
@@ -145,70 +217,61 @@ func CreateTerminal(details TerminalDeploy) error {
 	}
 
 	// pull mt4/5 image/data and have it present locally (maybe always have it ready and then just update when needed)
-	podDetails, err := setupAndStartPodmanContainer(details)
+	podDetails, err := setupAndStartPodmanContainer(details, controllerAddr, secret, runtime, bases)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if os.Getenv("USE_PODS") == "true" {
-		if err := runTerminalPodman(podDetails); err != nil {
-			return err
-		}
-	} else {
-		if err := runTerminalRaw(podDetails); err != nil {
-			return err
-		}
+	if err := runTerminal(podDetails); err != nil {
+		return nil, err
 	}
 
 	// create TerminalInstance (if user scheduled start when finished deploying, we just call start later)
 
-	return nil
+	return podDetails, nil
 }
 
-func runTerminalRaw(pod *PodmanDetails) error {
-	if _, err := os.Stat(pod.execPath); os.IsNotExist(err) {
-		return fmt.Errorf("executable not found: %s", pod.execPath)
-	}
+func runTerminal(pod *PodmanDetails) error {
+	return pod.runtime.Start(pod)
+}
 
-	cmd := exec.Command(pod.execPath, "/portable", pod.configPath)
-	cmd.Dir = filepath.Dir(pod.execPath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// stopTerminal halts the terminal process, remove also destroys the pod so the next start recreates it
+func stopTerminal(pod *PodmanDetails, remove bool) error {
+	if err := pod.runtime.Stop(pod); err != nil {
+		return err
+	}
 
-	fmt.Printf("Launching portable terminal: %s\n", pod.execPath)
-	return cmd.Start() // use Wait() if you want blocking
-}
+	if remove {
+		return pod.runtime.Destroy(pod)
+	}
 
-func runTerminalPodman(pod *PodmanDetails) error {
-	log.Printf("podman terminal run not implemented: %s", pod.podId)
 	return nil
 }
 
-func (term *Terminal) Start() {
-	// start the terminal
-	// maybe queue a task named "wait_for_terminal_startup" on the controller
-	// controller waits for the terminal with that id to come online
-	// if it doesn't within a specific time
-	// try restarting the pod
-	// queue another wait for terminal startup task
-	// if it doesn't come online, delete the pod and start from create terminal again (of course pull terminal details - login, password, etc.)
-	// log failure to admins and maybe push logs from mt4/5 to the admin log instance (send notification maybe)
+func (term *Terminal) SetSecret(secret string) {
+	term.mu.Lock()
+	defer term.mu.Unlock()
+	term.secret = secret
 }
 
-func (term *Terminal) Restart() {
-	// call stop
-	// call start
+// LoadSecret reads the secret back from the EA params in the terminal directory
+func (term *Terminal) LoadSecret() error {
+	term.mu.Lock()
+	defer term.mu.Unlock()
+
+	secret, err := readSecret(term.terminalPath, term.Type)
+	if err != nil {
+		return err
+	}
+
+	term.secret = secret
+	return nil
 }
 
-func (term *Terminal) Stop() {
-	// maybe separate normal and full close
-	// so full close stops the ea first and then closes the chart (doesn't seem to be able to done in a single call no? -> maybe just send command to close the ea and then wait for response or no messages from terminal within 2 seconds, if none, we just mark it as stopped then return)
-	// so a blocking execution (full stop)
-	// once term is stopped, we close the pod and maybe even delete it since we will have to initialize using the config method
-	// temporary/normal stop just shuts down the terminal so this is pod related
-	// send task to ea to tell it to unload + close charts?
-	// close the pod the terminal belongs to
-	// send response of the task
+func (term *Terminal) verifyAuth(nonce string, mac string) bool {
+	term.mu.RLock()
+	defer term.mu.RUnlock()
+	return verifyAuth(term.secret, nonce, term.Id, mac)
 }
 
 func (term *Terminal) touch() {
@@ -223,16 +286,129 @@ func (term *Terminal) LastSeen() time.Time {
 	return term.lastSeen
 }
 
-func (term *Terminal) SendTask(task common.TaskReq) {
+// SendTask queues the task for the EA without blocking, a full queue returns an error
+func (term *Terminal) SendTask(task common.TaskReq) error {
+	dropped, err := term.queue.push(task)
+	if err != nil {
+		return fmt.Errorf("[ctrl] terminal %s: %w", term.Id, err)
+	}
+
+	if task.Id != 0 {
+		term.inflight.track(task)
+	}
+
+	if dropped != nil {
+		term.inflight.forget(dropped.Id)
+		log.Printf("[ctrl] terminal %s queue full, dropped data request %d", term.Id, dropped.Id)
+		go term.reportErr(term.ctx, *dropped, fmt.Sprintf("[ctrl] terminal %s queue full, request dropped", term.Id))
+	}
+
+	return nil
+}
+
+// send is for retries and status queries, they are already tracked and retried again if this fails
+func (term *Terminal) send(task common.TaskReq) {
+	if _, err := term.queue.push(task); err != nil {
+		log.Printf("[ctrl] terminal %s: failed to queue retry of %d: %v", term.Id, task.Id, err)
+	}
+}
+
+// retryLoop resends tasks the terminal hasn't answered in time and fails them once out of attempts
+func (term *Terminal) retryLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			send, expired := term.inflight.due(now)
+			for _, task := range send {
+				term.send(task)
+			}
+
+			if len(expired) == 0 {
+				continue
+			}
+
+			silent := false
+			for _, entry := range expired {
+				// nothing at all since we first sent it, not just a slow task
+				if term.LastSeen().Before(entry.firstSent) {
+					silent = true
+				}
+				term.failTask(ctx, entry, "did not respond")
+			}
+
+			if silent {
+				log.Printf("[ctrl] terminal %s is unresponsive, dropping its connection", term.Id)
+				for _, entry := range term.inflight.drain() {
+					term.failTask(ctx, entry, "is unresponsive")
+				}
+				term.dropConnection()
+				return
+			}
+		}
+	}
+}
+
+// failTask answers the server in place of the terminal
+func (term *Terminal) failTask(ctx context.Context, entry inflightTask, reason string) {
+	msg := fmt.Sprintf("[ctrl] terminal %s %s after %d attempts", term.Id, reason, entry.attempts)
+	if entry.policy.SafeRetry {
+		msg += ", trade outcome unknown"
+	}
+
+	term.reportErr(ctx, entry.task, msg)
+}
+
+// reportErr sends an error result for the task to the server through the response fan-in
+func (term *Terminal) reportErr(ctx context.Context, task common.TaskReq, msg string) {
+	res := common.TaskRes{
+		ReqId:       task.Id,
+		ReqType:     string(task.ReqType),
+		ReqSubType:  string(task.ReqSubType),
+		MiscDetails: task.MiscDetails,
+		Err:         msg,
+	}
+	term.stamp(&res)
+
+	term.mu.RLock()
+	responses := term.taskResponse
+	term.mu.RUnlock()
+
+	select {
+	case <-ctx.Done():
+	case responses <- res:
+	}
+}
+
+func (term *Terminal) dropConnection() {
 	term.mu.Lock()
 	defer term.mu.Unlock()
 
-	select {
-	case <-term.ctx.Done():
-		return
-	case term.taskRequests <- task:
-		return
+	if term.connCancel != nil {
+		term.connCancel()
+	}
+	if term.conn != nil {
+		(*term.conn).Close()
+	}
+}
+
+// stamp fills in who the result came from, the EA can't speak for other terminals
+func (term *Terminal) stamp(res *common.TaskRes) {
+	term.mu.RLock()
+	defer term.mu.RUnlock()
+
+	if res.MiscDetails == nil {
+		res.MiscDetails = &common.TerminalMiscData{}
 	}
+
+	res.MiscDetails.TerminalId = term.Id
+	res.MiscDetails.AccountId = term.login
+	res.MiscDetails.Server = term.server
+	res.MiscDetails.Master = term.master
 }
 
 func (term *Terminal) UpdateResponseChan(termResChan chan common.TaskRes) {
@@ -241,94 +417,185 @@ func (term *Terminal) UpdateResponseChan(termResChan chan common.TaskRes) {
 	term.taskResponse = termResChan
 }
 
-func (term *Terminal) HandleConnection(parentCtx context.Context, conn *net.Conn) {
+// HandleConnection attaches an authenticated EA connection, a reconnect replaces the previous one
+func (term *Terminal) HandleConnection(conn *net.Conn, codec frameCodec) {
 	if conn == nil {
 		return
 	}
 
 	term.mu.Lock()
+	if !term.setStateLocked(StateOnline) {
+		term.mu.Unlock()
+		(*conn).Close()
+		return
+	}
+
+	if term.connCancel != nil {
+		log.Printf("[ctrl] terminal %s reconnected, dropping the old connection", term.Id)
+		term.connCancel()
+		(*term.conn).Close()
+	}
+
+	ctx, cancel := context.WithCancel(term.ctx)
 	term.conn = conn
-	term.ctx, term.cancel = context.WithCancel(parentCtx)
+	term.connCancel = cancel
 	term.lastSeen = time.Now()
 	term.mu.Unlock()
 
-	go term.taskResponseWriter()
+	log.Printf("[ctrl] terminal %s online (%s framing)", term.Id, codec.Mode())
+
+	go term.taskResponseWriter(ctx, codec)
+	go term.retryLoop(ctx)
+
+	// done before reading so a live result and its stored file can't both go out
+	term.resendStoredResponses(ctx)
 
 	// this is blocking
-	term.taskRequestReader()
+	term.taskRequestReader(ctx, codec)
 
-	term.cancel()
+	cancel()
 	(*conn).Close()
 
-	// unregister the terminal from the registry I believe
+	term.mu.Lock()
+	defer term.mu.Unlock()
+
+	// a reconnect may have replaced us already
+	if term.conn == conn {
+		term.conn = nil
+		term.connCancel = nil
+		if term.state == StateOnline {
+			term.setStateLocked(StateOffline)
+		}
+	}
 }
 
-func (term *Terminal) taskRequestReader() {
-	decoder := json.NewDecoder(*term.conn)
+func (term *Terminal) taskRequestReader(ctx context.Context, codec frameCodec) {
+	decodeErrors := 0
+
+	term.mu.RLock()
+	responses := term.taskResponse
+	term.mu.RUnlock()
+
+	if responses == nil {
+		log.Printf("[ctrl] terminal %s has nowhere to send results, dropping connection", term.Id)
+		return
+	}
 
 	for {
 		select {
-		case <-term.ctx.Done():
+		case <-ctx.Done():
 			return
 		default:
 		}
 
 		var msg common.TaskRes
 
-		if err := decoder.Decode(&msg); err != nil {
+		raw, err := codec.ReadMessage()
+		if err == nil {
+			err = json.Unmarshal(raw, &msg)
+		} else if !errors.Is(err, ErrBadChecksum) {
+			// the stream itself is broken (eof, oversized frame), the EA has to reconnect
 			if err == io.EOF {
 				log.Printf("conn EOF %s", term.Id)
 			} else {
-				log.Printf("decode error from %s: %v", term.Id, err)
+				log.Printf("read error from %s: %v", term.Id, err)
 			}
+			return
 		}
 
+		if err != nil {
+			// a single bad message is skipped, a run of them means the EA is broken
+			decodeErrors++
+			log.Printf("decode error from %s (%d/%d): %v", term.Id, decodeErrors, maxDecodeErrors, err)
+			if decodeErrors >= maxDecodeErrors {
+				log.Printf("[ctrl] too many bad messages from terminal %s, dropping connection", term.Id)
+				return
+			}
+			continue
+		}
+		decodeErrors = 0
+
 		// mark terminal as active
 		term.touch()
 
+		// watchdog probes, the touch above was all they were for
+		if msg.ReqSubType == string(common.DataTaskHeartbeat) {
+			continue
+		}
+
+		if msg.ReqSubType == string(common.AccountTaskUnload) {
+			select {
+			case term.unloaded <- struct{}{}:
+			default:
+			}
+			continue
+		}
+
+		forward, resend := term.inflight.resolve(msg)
+		if resend != nil {
+			log.Printf("[ctrl] terminal %s never saw request %d, resending", term.Id, resend.Id)
+			term.send(*resend)
+		}
+
+		if !forward {
+			continue
+		}
+
+		// every result is forwarded, a request may have many. Marked so the next resend skips
+		// its file, handed back if the push is interrupted
+		term.files.markSent(msg.ReqId)
+
+		term.stamp(&msg)
+
+		// blocking on purpose, we stop reading (and the EA stops writing) until there is room
 		select {
-		case term.taskResponse <- msg:
-		default:
-			log.Printf("inbound queue full, dropping message")
+		case <-ctx.Done():
+			term.files.release(msg.ReqId)
+			return
+		case responses <- msg:
 		}
 	}
 }
 
-func (term *Terminal) taskResponseWriter() {
+func (term *Terminal) taskResponseWriter(ctx context.Context, codec frameCodec) {
 	for {
-		select {
-		case <-term.ctx.Done():
+		data, ok := term.queue.pop(ctx)
+		if !ok {
 			return
-		case data := <-term.taskRequests:
-			if term.conn == nil {
-				term.Shutdown()
-				return
-			}
+		}
 
-			rawBytes, err := json.Marshal(data)
-			if err != nil {
-				log.Printf("[term] failed to marshal req: %s: %v", term.Id, err)
-				continue
-			}
+		rawBytes, err := json.Marshal(data)
+		if err != nil {
+			log.Printf("[term] failed to marshal req: %s: %v", term.Id, err)
+			continue
+		}
 
-			var compactBuffer bytes.Buffer
-			if err := json.Compact(&compactBuffer, rawBytes); err != nil {
-				log.Printf("[term] error compacting buffer: %s: %v", term.Id, err)
+		if err := codec.WriteMessage(rawBytes); err != nil {
+			if errors.Is(err, ErrFrameTooLarge) {
+				log.Printf("[term] req %d too large for term: %s: %v", data.Id, term.Id, err)
+				term.inflight.forget(data.Id)
+				go term.reportErr(ctx, data, fmt.Sprintf("[ctrl] request too large for terminal %s: %v", term.Id, err))
 				continue
 			}
 
-			if _, err := (*term.conn).Write(append(compactBuffer.Bytes(), '\n')); err != nil {
-				log.Printf("[term] failed to send req to term: %s: %v", term.Id, err)
-				continue
-			}
+			// the connection is gone, keep the task for the next one
+			log.Printf("[term] failed to send req to term: %s: %v", term.Id, err)
+			term.queue.pushFront(data)
+			return
 		}
 	}
 }
 
+// Shutdown drops the EA connection and stops the terminal from accepting new ones
 func (term *Terminal) Shutdown() {
 	term.mu.Lock()
 	defer term.mu.Unlock()
+
+	term.setStateLocked(StateStopping)
 	term.cancel()
+	if term.conn != nil {
+		(*term.conn).Close()
+	}
 }
 
 func (term *Terminal) IdentifyTrades() {
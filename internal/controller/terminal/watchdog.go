@@ -0,0 +1,155 @@
+package terminal
+
+import (
+	"backend/internal/common"
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+var DefaultWatchdog = common.WatchdogConfig{
+	Interval:     10 * time.Second,
+	StaleAfter:   30 * time.Second,
+	RestartAfter: 2 * time.Minute,
+	MaxRestarts:  3,
+}
+
+// Events reports terminal state changes and watchdog actions, forwarded to the server
+func (tc *TerminalConnector) Events() <-chan common.TerminalEvent {
+	return tc.events
+}
+
+// emitLocked queues an event about the terminal (caller holds term.mu), events are dropped when nobody drains them
+func (term *Terminal) emitLocked(kind common.TerminalEventKind, msg string) {
+	if term.events == nil {
+		return
+	}
+
+	event := common.TerminalEvent{
+		TerminalId: term.Id,
+		AccountId:  term.login,
+		Server:     term.server,
+		Kind:       kind,
+		State:      term.state.String(),
+		Message:    msg,
+		At:         time.Now(),
+	}
+
+	select {
+	case term.events <- event:
+	default:
+		log.Printf("[ctrl] event queue full, dropping %s event of terminal %s", kind, term.Id)
+	}
+}
+
+func (term *Terminal) emit(kind common.TerminalEventKind, msg string) {
+	term.mu.RLock()
+	defer term.mu.RUnlock()
+	term.emitLocked(kind, msg)
+}
+
+type watchdogAction int
+
+const (
+	watchNothing watchdogAction = iota
+	watchHeartbeat
+	watchStale
+	watchRestart
+	watchGiveUp
+)
+
+// check decides what the watchdog does with the terminal, restart bookkeeping happens here under the lock
+func (term *Terminal) check(now time.Time, conf common.WatchdogConfig) watchdogAction {
+	term.mu.Lock()
+	defer term.mu.Unlock()
+
+	switch term.state {
+	case StateOnline:
+		if now.Sub(term.lastSeen) > conf.StaleAfter {
+			return watchStale
+		}
+
+		// only a terminal that stays up earns its restarts back, a crash loop keeps counting
+		if term.restarts > 0 && now.Sub(term.stateSince) > conf.RestartAfter {
+			term.restarts = 0
+			term.restartBackoff.Reset()
+		}
+
+		return watchHeartbeat
+
+	case StateOffline, StateAwaitingConnect:
+		if now.Sub(term.stateSince) < conf.RestartAfter || now.Before(term.nextRestart) {
+			return watchNothing
+		}
+
+		if term.restarts >= conf.MaxRestarts {
+			return watchGiveUp
+		}
+
+		term.restarts++
+		term.nextRestart = now.Add(term.restartBackoff.Next())
+		return watchRestart
+	}
+
+	return watchNothing
+}
+
+// watchdog heartbeats online terminals, drops the stale ones and restarts terminals that stay offline
+func (tc *TerminalConnector) watchdog(ctx context.Context) {
+	if tc.watchdogConf.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(tc.watchdogConf.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			tc.mu.RLock()
+			terminals := make([]*Terminal, 0, len(tc.terminals))
+			for _, term := range tc.terminals {
+				terminals = append(terminals, term)
+			}
+			tc.mu.RUnlock()
+
+			for _, term := range terminals {
+				tc.watch(term, now)
+			}
+		}
+	}
+}
+
+func (tc *TerminalConnector) watch(term *Terminal, now time.Time) {
+	switch term.check(now, tc.watchdogConf) {
+	case watchHeartbeat:
+		// untracked, any message from the EA counts as an answer
+		term.send(common.TaskReq{ReqType: common.DataTask, ReqSubType: common.DataTaskHeartbeat})
+
+	case watchStale:
+		silence := now.Sub(term.LastSeen()).Round(time.Second)
+		log.Printf("[ctrl] terminal %s silent for %s, dropping its connection", term.Id, silence)
+		term.emit(common.EventStale, fmt.Sprintf("no messages for %s", silence))
+		term.dropConnection()
+
+	case watchRestart:
+		log.Printf("[ctrl] terminal %s still offline, restarting it", term.Id)
+		term.emit(common.EventRestart, "")
+
+		// blocks until the EA is back, the next checks skip it while it's stopping/starting
+		go func() {
+			if err := term.Restart(tc.ctx); err != nil {
+				log.Printf("[ctrl] failed to restart terminal %s: %v", term.Id, err)
+				term.emit(common.EventRestartFailed, err.Error())
+			}
+		}()
+
+	case watchGiveUp:
+		log.Printf("[ctrl] terminal %s did not come back after %d restarts, giving up", term.Id, tc.watchdogConf.MaxRestarts)
+		term.setState(StateFailed)
+		term.emit(common.EventGaveUp, fmt.Sprintf("offline after %d restarts", tc.watchdogConf.MaxRestarts))
+	}
+}
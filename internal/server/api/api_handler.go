@@ -23,9 +23,9 @@ func apiHandler(ctrlManager *manager.Manager) http.Handler {
 	mux := http.NewServeMux()
 
 	usersService := &users.UsersApiService{}
-	// mux.Handle("/api/users", http.StripPrefix("/api/users", corsMw.Wrap(usersService.ApiHandler(ctrlManager.Outgoing))))
+	// mux.Handle("/api/users", http.StripPrefix("/api/users", corsMw.Wrap(usersService.ApiHandler(ctrlManager))))
 
-	mux.Handle("/api/users/", http.StripPrefix("/api/users", usersService.ApiHandler(ctrlManager.Outgoing)))
+	mux.Handle("/api/users/", http.StripPrefix("/api/users", usersService.ApiHandler(ctrlManager)))
 	mux.HandleFunc("/ws", ctrlManager.HandleConnection)
 	mux.HandleFunc("/api/test", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("test endpoint hit"))
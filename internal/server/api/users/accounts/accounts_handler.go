@@ -2,25 +2,55 @@ package accounts
 
 import (
 	"backend/internal/common"
+	"backend/internal/server/manager"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
+	"time"
 )
 
 // have an accountId -> controller map
 // controller will have accountId -> accountLogin + server map to correctly send to the right account
 
 type AccountsApiService struct {
-	outgoingChan chan common.TaskReq
+	ctrlManager *manager.Manager
 }
 
-func NewAccountsApiService(ctrlChan chan common.TaskReq) *AccountsApiService {
+func NewAccountsApiService(ctrlManager *manager.Manager) *AccountsApiService {
 	return &AccountsApiService{
-		outgoingChan: ctrlChan,
+		ctrlManager: ctrlManager,
 	}
 }
 
+// deploying clones the terminal and waits for its EA to connect, slower than a plain request
+const deployTimeout = 5 * time.Minute
+
+// messageTasks are the tasks users may send to their terminals, account and controller
+// tasks only go out through their own endpoints
+var messageTasks = map[common.TaskType][]common.TaskSubType{
+	common.TradeTask: {common.TradeTaskAdd, common.TradeTaskMod},
+	common.DataTask: {
+		common.DataTaskSymbol,
+		common.DataTaskPrice,
+		common.DataTaskAccount,
+		common.DataTaskTrades,
+		common.DataTaskPriceFeed,
+	},
+}
+
+// writeSubmitted tells the caller which request id to look out for in later updates
+func writeSubmitted(w http.ResponseWriter, requestId int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]any{
+		"request_id": requestId,
+		"message":    msg,
+	})
+}
+
 func (a *AccountsApiService) deployAccount(w http.ResponseWriter, r *http.Request) {
 	var account struct {
 		Login             int    `json:"login"`
@@ -29,6 +59,7 @@ func (a *AccountsApiService) deployAccount(w http.ResponseWriter, r *http.Reques
 		Type              string `json:"type"`
 		Investor_password string `json:"investor_password,omitempty"`
 		Server_file       string `json:"server_file,omitempty"`
+		Master            bool   `json:"master,omitempty"` // copy master, its trades are the copy signals
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&account); err != nil {
@@ -44,23 +75,37 @@ func (a *AccountsApiService) deployAccount(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	select {
-	case a.outgoingChan <- common.TaskReq{
-		Id: 394,
+	// the controller answers once the terminal is deployed and started
+	pending, err := a.ctrlManager.Submit(common.TaskReq{
 		MiscDetails: &common.TerminalMiscData{
 			AccountId: account.Login,
 			Server:    account.Server,
+			Master:    account.Master,
 		},
 		ReqType:    common.AccountTask,
 		ReqSubType: common.AccountTaskCreate,
 		Payload:    payloadBytes,
-	}:
-		w.Write([]byte("succesfully submitted account deployment task. please wait for updates"))
-	default:
+	}, deployTimeout)
+	if err != nil {
+		log.Printf("failed to queue deployment task: %v", err)
 		http.Error(w, "failed to queue deployment task. please try again later", http.StatusRequestTimeout)
+		return
+	}
+
+	res, err := pending.Wait(r.Context())
+	if err != nil {
+		// a late result is no longer claimed, the manager hands it to the unclaimed consumer
+		a.ctrlManager.Cancel(pending.Id)
+		log.Printf("deployment %d of %d@%s still running: %v", pending.Id, account.Login, account.Server, err)
+		writeSubmitted(w, pending.Id, "account deployment is still running. please wait for updates")
+		return
 	}
 
-	w.Write([]byte("succesfully deployed account"))
+	w.Header().Set("Content-Type", "application/json")
+	if res.Err != "" {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(res)
 }
 
 /*
@@ -78,21 +123,36 @@ func (a *AccountsApiService) deleteAccount(w http.ResponseWriter, r *http.Reques
 	// might need a periodic check of the db and the controllers to make sure no residual accounts remain
 
 	// send task to the controller - based on the id
-	select {
-	case a.outgoingChan <- common.TaskReq{
-		Id: 987384,
+	pending, err := a.ctrlManager.Submit(common.TaskReq{
 		MiscDetails: &common.TerminalMiscData{
 			AccountId: accountId,
 			Server:    server,
 		},
 		ReqType:    common.AccountTask,
 		ReqSubType: common.AccountTaskDelete,
-	}:
-		w.Write([]byte("successfully queued delete action"))
-	default:
+	}, 0)
+	if err != nil {
+		log.Printf("failed to queue account deletion task: %v", err)
 		http.Error(w, "failed to queue account deletion task", http.StatusRequestTimeout)
+		return
 	}
-	w.Write([]byte("delete account for account: " + r.PathValue("account_id")))
+
+	// a controller that can't delete accounts rejects the task right away
+	res, err := pending.Wait(r.Context())
+	if err != nil {
+		a.ctrlManager.Cancel(pending.Id)
+		writeSubmitted(w, pending.Id, "account deletion is still running. please wait for updates")
+		return
+	}
+
+	if res.Err != "" {
+		log.Printf("failed to delete account %s: %s", r.PathValue("account_id"), res.Err)
+		http.Error(w, "failed to delete account: "+res.Err, http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
 }
 func (a *AccountsApiService) shutdownAccount(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("shutdown for account: " + r.PathValue("account_id")))
@@ -104,18 +164,46 @@ func (a *AccountsApiService) updateAccount(w http.ResponseWriter, r *http.Reques
 }
 
 func (a *AccountsApiService) messageAccount(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte("msg received for acc: " + r.PathValue("account_id")))
+	var msg struct {
+		Login   int                `json:"login"`
+		Server  string             `json:"server"`
+		Type    common.TaskType    `json:"type"`
+		SubType common.TaskSubType `json:"sub_type"`
+		Payload json.RawMessage    `json:"payload,omitempty"`
+	}
 
-	req := common.TaskReq{Id: 89394}
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, "invalid data", http.StatusBadRequest)
+		return
+	}
+
+	if subTypes, ok := messageTasks[msg.Type]; !ok || !slices.Contains(subTypes, msg.SubType) {
+		http.Error(w, fmt.Sprintf("can't message an account with %s/%s", msg.Type, msg.SubType), http.StatusBadRequest)
+		return
+	}
+
+	// waits for the terminal to answer so the caller gets the result directly
+	res, err := a.ctrlManager.Request(r.Context(), common.TaskReq{
+		MiscDetails: &common.TerminalMiscData{
+			AccountId: msg.Login,
+			Server:    msg.Server,
+		},
+		ReqType:    msg.Type,
+		ReqSubType: msg.SubType,
+		Payload:    msg.Payload,
+	}, 0)
 
-	select {
-	case a.outgoingChan <- req:
+	if errors.Is(err, manager.ErrRequestTimeout) {
+		http.Error(w, "account did not respond in time", http.StatusGatewayTimeout)
 		return
-	default:
-		log.Println("failed to send msg to channel")
+	} else if err != nil {
+		log.Printf("failed to message acc %s: %v", r.PathValue("account_id"), err)
+		http.Error(w, "failed to send message to account", http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
 }
 
 func (a *AccountsApiService) ApiHandler() http.Handler {
@@ -1,8 +1,8 @@
 package users
 
 import (
-	"backend/internal/common"
 	"backend/internal/server/api/users/accounts"
+	"backend/internal/server/manager"
 	"net/http"
 )
 
@@ -16,10 +16,10 @@ func (u *UsersApiService) subscribe(w http.ResponseWriter, r *http.Request)
 func (u *UsersApiService) unsubscribe(w http.ResponseWriter, r *http.Request)   {}
 func (u *UsersApiService) deleteDetails(w http.ResponseWriter, r *http.Request) {}
 
-func (u *UsersApiService) ApiHandler(ctrlChan chan common.TaskReq) http.Handler {
+func (u *UsersApiService) ApiHandler(ctrlManager *manager.Manager) http.Handler {
 	mux := http.NewServeMux()
 
-	accService := accounts.NewAccountsApiService(ctrlChan)
+	accService := accounts.NewAccountsApiService(ctrlManager)
 
 	mux.Handle("/accounts/", http.StripPrefix("/accounts", accService.ApiHandler()))
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
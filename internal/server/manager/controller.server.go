@@ -3,6 +3,7 @@ package manager
 import (
 	"backend/internal/common"
 	"context"
+	"fmt"
 	"log"
 	"sync"
 	"time"
@@ -22,10 +23,20 @@ type Controller struct {
 	accounts  map[string]struct{} // account id's
 	updatedAt time.Time
 
+	// from the hello exchange
+	build           string
+	protocolVersion int
+	caps            common.Capabilities // features here are the negotiated ones
+	inventory       []common.InventoryItem
+	onInventory     func(*Controller, common.Inventory) // lets the registry index reported accounts
+	onEvent         func(common.TerminalEvent)          // terminal events, handed to the manager
+
 	// communication
-	conn     *websocket.Conn
-	SendChan chan []byte // outgoing messages to the controller
-	outbound chan<- common.TaskRes
+	conn      *websocket.Conn
+	SendChan  chan []byte                          // outgoing messages to the controller
+	outbound  *common.Lanes[common.TaskRes]        // shared with the manager, one lane per priority
+	unacked   *common.RetryTracker[common.TaskReq] // requests the controller has not acked yet
+	heartbeat common.HeartbeatConfig
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -41,17 +52,19 @@ Registry doesn't need any locks for handling controller connect checks since it
 Same applies to the number of accounts connected (length vs capacity)
 */
 
-func NewController(id string, capacity int, outbound chan<- common.TaskRes) *Controller {
+func NewController(id string, capacity int, outbound *common.Lanes[common.TaskRes], conf common.ServerConfig) *Controller {
 	return &Controller{
 		Id:        id,
 		capacity:  capacity,
 		updatedAt: time.Now(),
-		SendChan:  make(chan []byte),
+		SendChan:  make(chan []byte, 256),
 		accounts:  make(map[string]struct{}),
 		length:    0,
 		connected: false,
 		conn:      nil,
 		outbound:  outbound,
+		unacked:   common.NewRetryTracker[common.TaskReq](conf.AckRetry),
+		heartbeat: conf.Heartbeat.WithDefaults(),
 	}
 }
 
@@ -80,8 +93,147 @@ func (c *Controller) SetConnection(parentCtx context.Context, conn *websocket.Co
 	c.connected = true
 	c.updatedAt = time.Now()
 
-	go c.readLoop()
-	go c.writeLoop()
+	// only does anything if deflate was negotiated during the upgrade
+	conn.EnableWriteCompression(c.caps.HasFeature(common.FeatureCompression))
+
+	// a controller that stops answering pings is dropped once the read deadline passes
+	readTimeout := c.heartbeat.ReadTimeout()
+	_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
+	conn.SetPongHandler(func(string) error {
+		c.touch()
+		return conn.SetReadDeadline(time.Now().Add(readTimeout))
+	})
+
+	// loops get their own copies so a reconnect can't swap the conn from under them
+	go c.readLoop(c.ctx, c.cancel, conn)
+	go c.writeLoop(c.ctx, c.cancel, conn)
+	go c.retryLoop(c.ctx)
+}
+
+// Send queues a request for the controller and keeps it until the controller acks it
+func (c *Controller) Send(task common.TaskReq) error {
+	if !c.Connected() {
+		return fmt.Errorf("controller %s not connected", c.Id)
+	}
+
+	data, err := common.EncodeEnvelope(common.MsgTask, task)
+	if err != nil {
+		return err
+	}
+
+	if task.ReqSubType != "" && !c.Supports(task.ReqSubType) {
+		return fmt.Errorf("controller %s does not support %s", c.Id, task.ReqSubType)
+	}
+
+	select {
+	case c.SendChan <- data:
+		// controllers that don't ack would have the request resent forever
+		if c.HasFeature(common.FeatureAckRetry) {
+			c.unacked.Track(task.Id, task)
+		}
+		return nil
+	default:
+		return fmt.Errorf("controller %s send buffer full", c.Id)
+	}
+}
+
+// SetHello records what the controller told us it supports
+func (c *Controller) SetHello(hello common.Hello, ack common.HelloAck) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.build = hello.Build
+	c.protocolVersion = ack.ProtocolVersion
+	c.caps = hello.Capabilities
+	c.caps.Features = ack.Features
+	c.capacity = hello.Capacity
+	c.updatedAt = time.Now()
+}
+
+func (c *Controller) Capabilities() common.Capabilities {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.caps
+}
+
+func (c *Controller) Supports(subType common.TaskSubType) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.caps.Supports(subType)
+}
+
+func (c *Controller) HasFeature(feature common.Feature) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.caps.HasFeature(feature)
+}
+
+func (c *Controller) SetCapacity(capacity int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.capacity = capacity
+	c.updatedAt = time.Now()
+}
+
+// FreeSlots is how many more accounts the controller can take
+func (c *Controller) FreeSlots() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.capacity - c.length
+}
+
+func (c *Controller) SetEventHandler(handler func(common.TerminalEvent)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onEvent = handler
+}
+
+func (c *Controller) handleEvent(event common.TerminalEvent) {
+	event.ControllerId = c.Id
+
+	c.mu.RLock()
+	handler := c.onEvent
+	c.mu.RUnlock()
+
+	if handler != nil {
+		handler(event)
+	}
+}
+
+// SetInventory replaces the accounts hosted on the controller with what it reported
+func (c *Controller) SetInventory(inv common.Inventory) {
+	c.mu.Lock()
+	c.inventory = inv.Terminals
+	c.updatedAt = time.Now()
+	c.mu.Unlock()
+
+	if c.onInventory != nil {
+		c.onInventory(c, inv)
+	}
+}
+
+func (c *Controller) Inventory() []common.InventoryItem {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.inventory
+}
+
+func (c *Controller) touch() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.updatedAt = time.Now()
+}
+
+func (c *Controller) disconnected(conn *websocket.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// a newer connection might have replaced this one already
+	if c.conn == conn && c.connected {
+		log.Printf("[%s] marked disconnected", c.Id)
+		c.connected = false
+		c.updatedAt = time.Now()
+	}
 }
 
 func (c *Controller) AppendAccount(accId string) {
@@ -100,48 +252,211 @@ func (c *Controller) RemoveAccount(accId string) {
 	defer c.mu.Unlock()
 
 	delete(c.accounts, accId)
+	c.length = len(c.accounts)
 	c.updatedAt = time.Now()
 	// update db call here
 }
 
-func (c *Controller) readLoop() {
-	// defer c.wg.Done()
+func (c *Controller) readLoop(ctx context.Context, cancel context.CancelFunc, conn *websocket.Conn) {
+	defer c.disconnected(conn)
+	defer conn.Close()
+	defer cancel()
+
+	readTimeout := c.heartbeat.ReadTimeout()
+
 	for {
 		select {
-		case <-c.ctx.Done():
+		case <-ctx.Done():
 			return
 		default:
-			_, msg, err := c.conn.ReadMessage()
+			_, msg, err := conn.ReadMessage()
 			if err != nil {
 				log.Printf("[%s] Read error: %v", c.Id, err)
-				// c.outbound <- ManagerMessage{ControllerId: c.Id, Type: "disconnect"}
-				c.cancel()
 				return
 			}
 
-			log.Printf("[%s] msg: %s", c.Id, msg)
-			// c.outbound <- ManagerMessage{ControllerId: c.Id, Type: "message", Data: msg}
+			// any frame proves the controller is alive
+			_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
+
+			env, err := common.DecodeEnvelope(msg)
+			if err != nil {
+				log.Printf("[%s] rejected message: %v", c.Id, err)
+				if !c.reply(ctx, common.MsgError, common.ErrorMsg{Message: err.Error()}) {
+					return
+				}
+				continue
+			}
+
+			switch env.Kind {
+			case common.MsgResult:
+				var res common.TaskRes
+				if err := env.Decode(&res); err != nil {
+					log.Printf("[%s] invalid response: %v", c.Id, err)
+					if !c.reply(ctx, common.MsgError, common.ErrorMsg{Message: err.Error()}) {
+						return
+					}
+					continue
+				}
+
+				if !c.deliver(ctx, res) {
+					return
+				}
+
+			case common.MsgBatch:
+				var batch common.ResultBatch
+				if err := env.Decode(&batch); err != nil {
+					log.Printf("[%s] invalid batch: %v", c.Id, err)
+					if !c.reply(ctx, common.MsgError, common.ErrorMsg{Message: err.Error()}) {
+						return
+					}
+					continue
+				}
+
+				for _, res := range batch.Results {
+					if !c.deliver(ctx, res) {
+						return
+					}
+				}
+
+			case common.MsgAck:
+				var ack common.TaskAck
+				if err := env.Decode(&ack); err != nil {
+					log.Printf("[%s] invalid ack: %v", c.Id, err)
+					continue
+				}
+
+				if ack.Kind == common.AckRequest {
+					c.unacked.Ack(ack.ReqId)
+				}
+
+			case common.MsgInventory:
+				var inv common.Inventory
+				if err := env.Decode(&inv); err != nil {
+					log.Printf("[%s] invalid inventory: %v", c.Id, err)
+					continue
+				}
+
+				c.SetInventory(inv)
+
+			case common.MsgEvent:
+				var event common.TerminalEvent
+				if err := env.Decode(&event); err != nil {
+					log.Printf("[%s] invalid event: %v", c.Id, err)
+					continue
+				}
+
+				c.handleEvent(event)
+
+			case common.MsgHeartbeat:
+				c.touch()
+
+			case common.MsgError:
+				var errMsg common.ErrorMsg
+				if err := env.Decode(&errMsg); err == nil {
+					log.Printf("[%s] controller reported error (request %d): %s", c.Id, errMsg.ReqId, errMsg.Message)
+				}
+
+			default:
+				log.Printf("[%s] unexpected %s message", c.Id, env.Kind)
+			}
 		}
 	}
 }
 
-func (c *Controller) writeLoop() {
-	// defer c.wg.Done()
+// deliver hands the response to the manager and acks it, only once it is handed off
+// since the controller resends anything we don't ack
+func (c *Controller) deliver(ctx context.Context, res common.TaskRes) bool {
+	if !c.outbound.Push(ctx, res) {
+		return false
+	}
+
+	ack := common.NewTaskAck(common.AckResponse, res.ReqId)
+	ack.Seq = res.Seq
+	return c.reply(ctx, common.MsgAck, ack)
+}
+
+// reply queues a message for the write loop, false if the connection is going away
+func (c *Controller) reply(ctx context.Context, kind common.MessageKind, payload any) bool {
+	data, err := common.EncodeEnvelope(kind, payload)
+	if err != nil {
+		log.Printf("[%s] %v", c.Id, err)
+		return true
+	}
+
+	select {
+	case c.SendChan <- data:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (c *Controller) writeLoop(ctx context.Context, cancel context.CancelFunc, conn *websocket.Conn) {
+	defer c.disconnected(conn)
+	defer conn.Close()
+	defer cancel()
+
+	pingTicker := time.NewTicker(c.heartbeat.PingInterval)
+	defer pingTicker.Stop()
+
 	for {
 		select {
-		case <-c.ctx.Done():
+		case <-ctx.Done():
 			return
+		case <-pingTicker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.heartbeat.PongTimeout)); err != nil {
+				log.Printf("[%s] Ping error: %v", c.Id, err)
+				return
+			}
 		case msg := <-c.SendChan:
-			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
 				log.Printf("[%s] Write error: %v", c.Id, err)
-				// c.outbound <- ManagerMessage{ControllerId: c.Id, Type: "disconnect"}
-				c.cancel()
 				return
 			}
 		}
 	}
 }
 
+// retryLoop resends requests the controller has not acked and fails the ones that ran out of attempts
+func (c *Controller) retryLoop(ctx context.Context) {
+	interval := c.unacked.Policy().Timeout / 4
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			retry, expired := c.unacked.Due(now)
+
+			for _, task := range retry {
+				if !c.reply(ctx, common.MsgTask, task) {
+					return
+				}
+			}
+
+			for _, task := range expired {
+				log.Printf("[%s] request %d not acked after %d attempts", c.Id, task.Id, c.unacked.Policy().MaxAttempts)
+
+				if !c.outbound.Push(ctx, common.TaskRes{
+					ReqId:       task.Id,
+					ReqType:     string(task.ReqType),
+					ReqSubType:  string(task.ReqSubType),
+					MiscDetails: task.MiscDetails,
+					Err:         fmt.Sprintf("controller %s did not ack the request", c.Id),
+				}) {
+					return
+				}
+			}
+		}
+	}
+}
+
 /*func (c *Controller) Disconnect() {
     if c.cancel != nil {
         c.cancel()
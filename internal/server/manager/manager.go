@@ -3,50 +3,150 @@ package manager
 import (
 	"backend/internal/common"
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 // tracks connected controllers
 type Manager struct {
-	registry *Registry
-	upgrader websocket.Upgrader
-	incoming chan common.TaskRes
-	Outgoing chan common.TaskReq
+	registry       *Registry
+	pending        *PendingTable
+	conf           common.ServerConfig
+	requestTimeout time.Duration
+	upgrader       websocket.Upgrader
+	incoming       *common.Lanes[common.TaskRes] // controller responses, drained in priority order
+	unclaimed      *common.Lanes[common.TaskRes] // responses nobody is waiting on, kept in their lanes
+	events         chan common.TerminalEvent     // terminal events from every controller
+	Outgoing       chan common.TaskReq
 	//reconnectChan  chan string
 	//disconnectChan chan string
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
-func NewManager(registry *Registry) *Manager {
+func NewManager(registry *Registry, conf common.ServerConfig) *Manager {
 	return &Manager{
-		registry: registry,
+		registry:       registry,
+		pending:        NewPendingTable(),
+		conf:           conf,
+		requestTimeout: conf.RequestTimeout,
 		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool { return true },
+			CheckOrigin:       func(r *http.Request) bool { return true },
+			EnableCompression: conf.Compression,
 		},
-		incoming: make(chan common.TaskRes),
-		Outgoing: make(chan common.TaskReq),
+		incoming:  common.NewLanes(1024, common.ResultPriority),
+		unclaimed: common.NewLanes(1024, common.ResultPriority),
+		events:    make(chan common.TerminalEvent, 1024),
+		Outgoing:  make(chan common.TaskReq),
 	}
 }
 
 func (m *Manager) Start(parentCtx context.Context) {
 	m.ctx, m.cancel = context.WithCancel(parentCtx)
 
+	go m.pending.run(m.ctx)
+	go m.dispatchIncoming()
+
 	log.Println("[server] Started server connection manager")
 	for {
 		select {
 		case <-m.ctx.Done():
 			log.Println("[server] Ctx closed")
-		case msg := <-m.Outgoing:
-			log.Println(msg)
+			return
+		case task := <-m.Outgoing:
+			if err := m.route(task); err != nil {
+				log.Printf("[server] failed to route task %d: %v", task.Id, err)
+				// let the caller know straight away instead of waiting for the deadline
+				m.pending.Resolve(common.TaskRes{
+					ReqId:       task.Id,
+					ReqType:     string(task.ReqType),
+					ReqSubType:  string(task.ReqSubType),
+					MiscDetails: task.MiscDetails,
+					Err:         err.Error(),
+				})
+			}
+		}
+	}
+}
+
+// dispatchIncoming matches controller responses to pending requests, the rest go to NextIncoming.
+// A full unclaimed lane blocks the dispatch until the consumer catches up, the controllers are
+// only acked once a response is queued so they hold on to theirs meanwhile
+func (m *Manager) dispatchIncoming() {
+	for {
+		res, ok := m.incoming.Next(m.ctx)
+		if !ok {
+			return
+		}
+
+		if m.pending.Resolve(res) {
+			continue
+		}
+
+		if !m.unclaimed.Push(m.ctx, res) {
+			return
 		}
 	}
 }
 
+// Submit allocates an id for the task, sends it and returns a handle to wait for the response.
+// A zero timeout uses the configured request timeout
+func (m *Manager) Submit(task common.TaskReq, timeout time.Duration) (*PendingRequest, error) {
+	return m.submit(task, timeout, false)
+}
+
+// Stream is like Submit but keeps receiving responses (feeds, snapshots) until the timeout or Cancel
+func (m *Manager) Stream(task common.TaskReq, timeout time.Duration) (*PendingRequest, error) {
+	return m.submit(task, timeout, true)
+}
+
+// Request submits the task and blocks until its response arrives or the request times out
+func (m *Manager) Request(ctx context.Context, task common.TaskReq, timeout time.Duration) (common.TaskRes, error) {
+	pr, err := m.Submit(task, timeout)
+	if err != nil {
+		return common.TaskRes{}, err
+	}
+
+	res, err := pr.Wait(ctx)
+	if err != nil {
+		m.pending.Cancel(pr.Id)
+	}
+
+	return res, err
+}
+
+func (m *Manager) Cancel(id int) {
+	m.pending.Cancel(id)
+}
+
+func (m *Manager) submit(task common.TaskReq, timeout time.Duration, stream bool) (*PendingRequest, error) {
+	if timeout == 0 {
+		timeout = m.requestTimeout
+	}
+
+	task.Id = m.pending.NextId()
+
+	var pr *PendingRequest
+	if stream {
+		pr = m.pending.Subscribe(task.Id, timeout)
+	} else {
+		pr = m.pending.Register(task.Id, timeout)
+	}
+
+	select {
+	case m.Outgoing <- task:
+		return pr, nil
+	case <-time.After(time.Second):
+		m.pending.Cancel(task.Id)
+		return nil, fmt.Errorf("failed to queue task %d", task.Id)
+	}
+}
+
 /*func (m *Manager) Start() {
 	for {
 		select {
@@ -83,20 +183,98 @@ func (m *Manager) HandleConnection(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	c := m.registry.GetOrCreateController(id, capacity, m.incoming)
+	hello, ack, err := m.hello(conn, id)
+	if err != nil {
+		log.Printf("[server] controller %s hello failed: %v", id, err)
+		conn.Close()
+		return
+	}
+
+	if !ack.Accepted {
+		log.Printf("[server] refused controller %s (build %s): %s", id, hello.Build, ack.Reason)
+		conn.Close()
+		return
+	}
+
+	log.Printf("[server] controller %s build %s speaks protocol v%d, features %v", id, hello.Build, ack.ProtocolVersion, ack.Features)
+
+	c := m.registry.GetOrCreateController(id, capacity, m.incoming, m.conf)
+	c.SetHello(hello, ack)
+	c.SetEventHandler(m.publishEvent)
 	c.SetConnection(m.ctx, conn)
 }
 
-func (m *Manager) Incoming() <-chan common.TaskRes {
-	// consume these messages and prioritize trades from master accounts
-	return m.incoming
+// hello reads the controllers hello and answers it, the controller is only registered if it was accepted
+func (m *Manager) hello(conn *websocket.Conn, id string) (common.Hello, common.HelloAck, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var hello common.Hello
+
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return hello, common.HelloAck{}, err
+	}
+
+	env, err := common.DecodeEnvelope(data)
+	if err != nil || env.Kind != common.MsgHello {
+		reason := fmt.Sprintf("expected %s envelope (protocol v%d+)", common.MsgHello, common.MinProtocolVersion)
+		if frame, encErr := common.EncodeEnvelope(common.MsgError, common.ErrorMsg{Message: reason}); encErr == nil {
+			conn.WriteMessage(websocket.TextMessage, frame)
+		}
+		return hello, common.HelloAck{}, fmt.Errorf("%s", reason)
+	}
+
+	if err := env.Decode(&hello); err != nil {
+		return hello, common.HelloAck{}, err
+	}
+
+	ack := common.Negotiate(hello, m.conf.Features())
+	if ack.Accepted && hello.ControllerId != id {
+		ack = common.HelloAck{
+			Reason: fmt.Sprintf("hello controller id %s does not match header %s", hello.ControllerId, id),
+		}
+	}
+
+	frame, err := common.EncodeEnvelope(common.MsgHelloAck, ack)
+	if err != nil {
+		return hello, ack, err
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+		return hello, ack, err
+	}
+
+	return hello, ack, nil
 }
 
-/* Consume Messages from controllers -> and use the publishers if need be
-go func() {
-    for msg := range wsManager.Incoming() {
-        // route to correct task handler, DB, etc.
-        log.Printf("Processing message from %s: %s", msg.ControllerID, msg.Payload)
-    }
-}()
-*/
+// route hands the task to the controller hosting its account, the controller retries it until acked
+func (m *Manager) route(task common.TaskReq) error {
+	c, err := m.registry.ControllerForTask(task)
+	if err != nil {
+		return err
+	}
+
+	return c.Send(task)
+}
+
+// NextIncoming returns the next controller response no pending request claimed, blocking until
+// there is one. Master trades come out ahead of price data, whatever order they arrived in
+func (m *Manager) NextIncoming(ctx context.Context) (common.TaskRes, bool) {
+	return m.unclaimed.Next(ctx)
+}
+
+func (m *Manager) publishEvent(event common.TerminalEvent) {
+	log.Printf("[server] terminal %s on controller %s: %s (%s) %s", event.TerminalId, event.ControllerId, event.Kind, event.State, event.Message)
+
+	select {
+	case m.events <- event:
+	default:
+		log.Printf("[server] event queue full, dropping %s event of terminal %s", event.Kind, event.TerminalId)
+	}
+}
+
+// Events delivers terminal events (online/offline, watchdog restarts) reported by the controllers
+func (m *Manager) Events() <-chan common.TerminalEvent {
+	return m.events
+}
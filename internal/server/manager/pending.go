@@ -0,0 +1,186 @@
+package manager
+
+import (
+	"backend/internal/common"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRequestTimeout  = errors.New("request timed out")
+	ErrRequestCanceled = errors.New("request canceled")
+)
+
+// PendingRequest is a task sent to a controller that we are still waiting on
+type PendingRequest struct {
+	Id       int
+	Deadline time.Time // zero means it only ends when canceled
+
+	stream  bool // subscriptions receive every response, plain requests only the first
+	results chan common.TaskRes
+	err     error
+}
+
+// Results delivers the responses for the request, closed once it times out or is canceled
+func (pr *PendingRequest) Results() <-chan common.TaskRes {
+	return pr.results
+}
+
+// Err explains why Results was closed (only valid after it is closed)
+func (pr *PendingRequest) Err() error {
+	return pr.err
+}
+
+// Wait blocks until the first response arrives
+func (pr *PendingRequest) Wait(ctx context.Context) (common.TaskRes, error) {
+	select {
+	case <-ctx.Done():
+		return common.TaskRes{}, ctx.Err()
+	case res, ok := <-pr.results:
+		if !ok {
+			return common.TaskRes{}, pr.err
+		}
+		return res, nil
+	}
+}
+
+// PendingTable allocates request ids and correlates controller responses back to the requests
+type PendingTable struct {
+	mu      sync.Mutex
+	lastId  int
+	pending map[int]*PendingRequest
+}
+
+func NewPendingTable() *PendingTable {
+	return &PendingTable{
+		// seed with the clock so ids don't repeat across server restarts (controllers dedupe on them)
+		lastId:  int(time.Now().UnixMilli()),
+		pending: make(map[int]*PendingRequest),
+	}
+}
+
+func (p *PendingTable) NextId() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastId++
+	return p.lastId
+}
+
+// Register waits for a single response to the request
+func (p *PendingTable) Register(id int, timeout time.Duration) *PendingRequest {
+	return p.add(id, timeout, false)
+}
+
+// Subscribe receives every response for the request (feeds, snapshots) until it times out or is canceled
+func (p *PendingTable) Subscribe(id int, timeout time.Duration) *PendingRequest {
+	return p.add(id, timeout, true)
+}
+
+func (p *PendingTable) add(id int, timeout time.Duration, stream bool) *PendingRequest {
+	pr := &PendingRequest{
+		Id:      id,
+		stream:  stream,
+		results: make(chan common.TaskRes, 1),
+	}
+
+	if stream {
+		pr.results = make(chan common.TaskRes, 64)
+	}
+
+	if timeout > 0 {
+		pr.Deadline = time.Now().Add(timeout)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if old, ok := p.pending[id]; ok {
+		p.finish(old, ErrRequestCanceled)
+	}
+	p.pending[id] = pr
+
+	return pr
+}
+
+// Resolve hands a response to whoever is waiting on it, false if nobody is
+func (p *PendingTable) Resolve(res common.TaskRes) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pr, ok := p.pending[res.ReqId]
+	if !ok {
+		return false
+	}
+
+	if !pr.stream {
+		pr.results <- res
+		delete(p.pending, pr.Id)
+		close(pr.results)
+		pr.err = nil
+		return true
+	}
+
+	select {
+	case pr.results <- res:
+	default:
+		// slow subscriber, drop the oldest so the newest data still gets through
+		select {
+		case <-pr.results:
+		default:
+		}
+		pr.results <- res
+	}
+
+	return true
+}
+
+func (p *PendingTable) Cancel(id int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if pr, ok := p.pending[id]; ok {
+		p.finish(pr, ErrRequestCanceled)
+	}
+}
+
+// Expire times out every request whose deadline has passed
+func (p *PendingTable) Expire(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, pr := range p.pending {
+		if !pr.Deadline.IsZero() && now.After(pr.Deadline) {
+			p.finish(pr, ErrRequestTimeout)
+		}
+	}
+}
+
+func (p *PendingTable) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pending)
+}
+
+// finish closes the request with a reason (caller holds the lock)
+func (p *PendingTable) finish(pr *PendingRequest, err error) {
+	delete(p.pending, pr.Id)
+	pr.err = err
+	close(pr.results)
+}
+
+// run expires requests until the context is done
+func (p *PendingTable) run(ctx context.Context) {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.Expire(now)
+		}
+	}
+}
@@ -22,11 +22,18 @@ func NewRegistry() *Registry {
 	}
 }
 
-func (r *Registry) GetOrCreateController(id string, capacity int, outbound chan<- common.TaskRes) *Controller {
+func (r *Registry) GetOrCreateController(id string, capacity int, outbound *common.Lanes[common.TaskRes], conf common.ServerConfig) *Controller {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	c := NewController(id, capacity, outbound)
+	// reconnecting controllers keep their accounts and unacked requests
+	if c, ok := r.controllers[id]; ok {
+		c.SetCapacity(capacity)
+		return c
+	}
+
+	c := NewController(id, capacity, outbound, conf)
+	c.onInventory = r.indexInventory
 
 	r.controllers[id] = c
 
@@ -89,8 +96,13 @@ func (r *Registry) RemoveAccount(accId string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	ctrlId, ok := r.accountIndex[accId]
+	if !ok {
+		return
+	}
+
 	delete(r.accountIndex, accId)
-	if c, ok := r.FindControllerByAccount(accId); ok {
+	if c, ok := r.controllers[ctrlId]; ok {
 		c.RemoveAccount(accId)
 	}
 }
@@ -108,6 +120,70 @@ func (r *Registry) FindControllerByAccount(accId string) (*Controller, bool) {
 	return c, ok
 }
 
+// indexInventory rebuilds the controller's accounts from what it reported, accounts it no longer
+// hosts stop routing to it
+func (r *Registry) indexInventory(c *Controller, inv common.Inventory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reported := make(map[string]struct{}, len(inv.Terminals))
+	for _, item := range inv.Terminals {
+		reported[common.AccountKey(item.AccountId, item.Server)] = struct{}{}
+	}
+
+	for accId, ctrlId := range r.accountIndex {
+		if _, ok := reported[accId]; ctrlId == c.Id && !ok {
+			delete(r.accountIndex, accId)
+			c.RemoveAccount(accId)
+		}
+	}
+
+	for accId := range reported {
+		r.accountIndex[accId] = c.Id
+		c.AppendAccount(accId)
+	}
+}
+
+// ControllerForTask finds the controller hosting the account named in the task.
+// New accounts are assigned to the connected controller with the most free slots
+func (r *Registry) ControllerForTask(task common.TaskReq) (*Controller, error) {
+	if task.MiscDetails == nil {
+		return nil, fmt.Errorf("task %d has no account details", task.Id)
+	}
+
+	accId := common.AccountKey(task.MiscDetails.AccountId, task.MiscDetails.Server)
+	if c, ok := r.FindControllerByAccount(accId); ok {
+		return c, nil
+	}
+
+	if task.ReqType != common.AccountTask || task.ReqSubType != common.AccountTaskCreate {
+		return nil, fmt.Errorf("no controller for account %s", accId)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var best *Controller
+	for _, c := range r.controllers {
+		if !c.Connected() || c.FreeSlots() <= 0 || !c.Supports(task.ReqSubType) {
+			continue
+		}
+
+		if best == nil || c.FreeSlots() > best.FreeSlots() {
+			best = c
+		}
+	}
+
+	if best == nil {
+		return nil, fmt.Errorf("no connected controller with free capacity supports %s for account %s", task.ReqSubType, accId)
+	}
+
+	best.AppendAccount(accId)
+	r.accountIndex[accId] = best.Id
+
+	return best, nil
+}
+
 func (r *Registry) SendTaskToAccount(accountID string, payload []byte) error {
 	ctrl, ok := r.FindControllerByAccount(accountID)
 	if !ok {
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"backend/internal/common"
 	"backend/internal/server/api"
 	"backend/internal/server/manager"
 	"context"
@@ -13,12 +14,12 @@ type Server struct {
 	CtrlsManager *manager.Manager
 }
 
-func NewServer(api_url string) (*Server, error) {
+func NewServer(conf common.ServerConfig) (*Server, error) {
 	registry := manager.NewRegistry()
-	ctrl_manager := manager.NewManager(registry)
+	ctrl_manager := manager.NewManager(registry, conf)
 
 	app := &Server{
-		ApiServer:    api.InitHandler(api_url, ctrl_manager),
+		ApiServer:    api.InitHandler(conf.Addr, ctrl_manager),
 		CtrlsManager: ctrl_manager,
 	}
 
@@ -27,7 +28,52 @@ func NewServer(api_url string) (*Server, error) {
 
 func (a *Server) Run(parentCtx context.Context) error {
 	go a.CtrlsManager.Start(parentCtx)
+	go a.consumeIncoming(parentCtx)
+	go a.consumeEvents(parentCtx)
 
 	log.Printf("[server] started server api")
 	return a.ApiServer.ListenAndServe()
 }
+
+// consumeIncoming drains the responses no request waited for (unsolicited trade updates, results that
+// came in after their request timed out), the manager stops acking controllers while they pile up
+func (a *Server) consumeIncoming(ctx context.Context) {
+	for {
+		res, ok := a.CtrlsManager.NextIncoming(ctx)
+		if !ok {
+			return
+		}
+
+		terminalId := ""
+		if res.MiscDetails != nil {
+			terminalId = res.MiscDetails.TerminalId
+		}
+
+		// TODO: route to the copier/db once those exist
+		if res.Err != "" {
+			log.Printf("[server] unclaimed %s/%s response %d from terminal %s failed: %s", res.ReqType, res.ReqSubType, res.ReqId, terminalId, res.Err)
+			continue
+		}
+		log.Printf("[server] unclaimed %s/%s response %d from terminal %s", res.ReqType, res.ReqSubType, res.ReqId, terminalId)
+	}
+}
+
+// consumeEvents drains the terminal events, the manager logs every one already. Terminals the
+// controller gave up on need someone to look at them
+func (a *Server) consumeEvents(ctx context.Context) {
+	events := a.CtrlsManager.Events()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			// TODO: notify the account owner once notifications exist
+			switch event.Kind {
+			case common.EventGaveUp, common.EventRestartFailed:
+				log.Printf("[server] terminal %s (%d@%s) on controller %s needs attention: %s %s",
+					event.TerminalId, event.AccountId, event.Server, event.ControllerId, event.Kind, event.Message)
+			}
+		}
+	}
+}